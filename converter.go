@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ConvertOptions are options that affect the output of a conversion.
+type ConvertOptions struct {
+	// PDFPageSize is the paper size used for PDF output, e. g. "a4" or "letter".
+	// An empty string leaves it to the backend's default.
+	PDFPageSize string
+	// NoClobber never replaces existing outputs, even if older than the input.
+	NoClobber bool
+}
+
+// ConverterBackend describes how to invoke an external conversion program.
+type ConverterBackend struct {
+	// Program is the name or path of the executable.
+	Program string
+	// Args builds the arguments to convert the input file into the output file.
+	// The output format is deduced by the program from the output extension.
+	Args func(input, output string, opts ConvertOptions) []string
+}
+
+// ConverterBackends maps a backend name to the way of invoking it.
+var ConverterBackends = map[string]ConverterBackend{
+	"ebook-convert": {
+		Program: "ebook-convert",
+		Args: func(input, output string, opts ConvertOptions) []string {
+			args := []string{input, output}
+			if opts.PDFPageSize != "" && strings.HasSuffix(output, ".pdf") {
+				args = append(args, "--paper-size", opts.PDFPageSize)
+			}
+
+			return args
+		},
+	},
+	"pandoc": {
+		Program: "pandoc",
+		Args: func(input, output string, opts ConvertOptions) []string {
+			args := []string{input, "-o", output}
+			if opts.PDFPageSize != "" && strings.HasSuffix(output, ".pdf") {
+				args = append(args, "-V", "papersize="+opts.PDFPageSize)
+			}
+
+			return args
+		},
+	},
+}
+
+// Converter produces formats not offered by Standard Ebooks from downloaded
+// epub files, using an external program.
+type Converter struct {
+	backend ConverterBackend
+	formats []string
+	opts    ConvertOptions
+}
+
+// NewConverter creates a new Converter.
+//
+// backend should be one of the keys of ConverterBackends, and formats a
+// comma-separated list of output extensions, e. g., "mobi,pdf".
+func NewConverter(backend string, formats string, opts ConvertOptions) (*Converter, error) {
+	b, ok := ConverterBackends[backend]
+	if !ok {
+		return nil, fmt.Errorf("the converter \"%s\" is not supported", backend)
+	}
+
+	formatsSlice := make([]string, 0)
+	for _, format := range strings.Split(formats, ",") {
+		format = strings.TrimPrefix(strings.TrimSpace(format), ".")
+		if format == "" {
+			return nil, fmt.Errorf("empty conversion format in \"%s\"", formats)
+		}
+
+		formatsSlice = append(formatsSlice, format)
+	}
+
+	return &Converter{
+		backend: b,
+		formats: formatsSlice,
+		opts:    opts,
+	}, nil
+}
+
+// CanConvert reports whether the given file is a valid input for conversion.
+// Only plain epubs are used, as they're the most widely supported by converters.
+func (conv *Converter) CanConvert(filename string) bool {
+	return FormatsTesters["epub"](filename)
+}
+
+// Convert converts the given epub file into all the configured formats, writing
+// the results next to it with the same base name. finalFilename is where the epub
+// will end up, e. g. in the library if filename is in a staging directory, or the
+// same filename otherwise.
+//
+// A conversion is skipped if its output already exists next to finalFilename and
+// is not older than the input, dated as upstream by the Downloader, so re-running
+// over the same library doesn't repeat work. It returns the names of the files
+// actually produced.
+func (conv *Converter) Convert(filename, finalFilename string) ([]string, error) {
+	inputInfo, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	finalBase := strings.TrimSuffix(finalFilename, filepath.Ext(finalFilename))
+	produced := make([]string, 0, len(conv.formats))
+
+	for _, format := range conv.formats {
+		existing := finalBase + "." + format
+		if existingInfo, err := os.Stat(existing); err == nil && (conv.opts.NoClobber || !existingInfo.ModTime().Before(inputInfo.ModTime())) {
+			continue
+		}
+
+		output := base + "." + format
+		cmd := exec.Command(conv.backend.Program, conv.backend.Args(filename, output, conv.opts)...)
+		combinedOutput, err := cmd.CombinedOutput()
+		if err != nil {
+			return produced, fmt.Errorf("while converting %s to %s: %v: %s", filename, format, err, strings.TrimSpace(string(combinedOutput)))
+		}
+
+		produced = append(produced, output)
+	}
+
+	return produced, nil
+}
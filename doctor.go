@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Finding is the result of one of the checks made by RunDoctor or RunSelfCheck.
+type Finding struct {
+	// Check is a short description of what was checked.
+	Check string
+	// Result describes what was found.
+	Result string
+	// Err is non-nil if the check failed, and should explain how to fix it.
+	Err error
+}
+
+// RunDoctor checks that everything needed for a successful run is in place: the
+// base directory is writable, the proxy configuration, if any, and connectivity
+// to Standard Ebooks.
+func RunDoctor(basedir string, pacer *Pacer, client *http.Client) []Finding {
+	findings := make([]Finding, 0, 3)
+
+	// Base directory
+	finding := Finding{Check: "base directory " + basedir}
+	err := CheckWritableDir(basedir)
+	if err != nil {
+		finding.Err = fmt.Errorf("%v; check its permissions or choose another one with -dir", err)
+	} else {
+		finding.Result = "writable"
+	}
+	findings = append(findings, finding)
+
+	// Proxy
+	finding = Finding{Check: "proxy"}
+	req, _ := http.NewRequest(http.MethodGet, StandardEbooksMainURL.String(), nil)
+	proxyURL, err := http.ProxyFromEnvironment(req)
+	switch {
+	case err != nil:
+		finding.Err = fmt.Errorf("invalid proxy configuration: %v; check the HTTPS_PROXY and NO_PROXY environment variables", err)
+	case proxyURL == nil:
+		finding.Result = "none"
+	default:
+		finding.Result = RedactURL(proxyURL)
+	}
+	findings = append(findings, finding)
+
+	// Connectivity, through the proxy if any
+	finding = Finding{Check: "connection to " + StandardEbooksMainURL.String()}
+	resp, release, err := pacer.Get(client, StandardEbooksMainURL.String())
+	if err != nil {
+		finding.Err = fmt.Errorf("%v; check your network connection and proxy", err)
+	} else {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			finding.Err = fmt.Errorf("unexpected response: %s", resp.Status)
+		} else {
+			finding.Result = resp.Status
+		}
+	}
+	release()
+	findings = append(findings, finding)
+
+	return findings
+}
+
+// PrintFindings prints the findings of a check, one per line, and returns the exit
+// code for them: 1 if any check failed, 0 otherwise.
+func PrintFindings(findings []Finding) int {
+	exitCode := 0
+	for _, finding := range findings {
+		if finding.Err != nil {
+			fmt.Printf("[problem] %s: %v\n", finding.Check, finding.Err)
+			exitCode = 1
+		} else {
+			fmt.Printf("[ok] %s: %s\n", finding.Check, finding.Result)
+		}
+	}
+
+	return exitCode
+}
+
+// RedactURL returns the URL as a string, with its password, if any, replaced by
+// "xxxxx", e. g. for logging the URL of a proxy.
+func RedactURL(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+	if _, hasPassword := u.User.Password(); !hasPassword {
+		return u.String()
+	}
+
+	redacted := *u
+	redacted.User = url.UserPassword(u.User.Username(), "xxxxx")
+
+	return redacted.String()
+}
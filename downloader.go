@@ -0,0 +1,784 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DownloadStats are statistics about the files downloaded by a Downloader.
+type DownloadStats struct {
+	// Files is the number of files downloaded.
+	Files int
+	// Bytes is the total number of bytes written.
+	Bytes int64
+	// Duration is the total time spent transferring files, not counting the wait
+	// between connections.
+	Duration time.Duration
+}
+
+// Speed returns the average transfer speed, in bytes per second.
+func (stats DownloadStats) Speed() float64 {
+	return BytesPerSecond(stats.Bytes, stats.Duration)
+}
+
+// BytesPerSecond returns the speed of transferring n bytes in duration d.
+func BytesPerSecond(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+
+	return float64(n) / d.Seconds()
+}
+
+// QueueItem is an ebook file waiting to be downloaded.
+type QueueItem struct {
+	// URL is the URL of the file, as returned by NormalizeURLs.
+	URL *url.URL
+	// Format is the format of the file, as returned by URLSet.Format.
+	Format string
+	// Dir is the absolute directory where the file will be saved, or empty to use
+	// the Downloader's options.
+	Dir string
+	// Options are the input options the file was found with.
+	Options InputOptions
+	// Explicit is whether the book of the file was asked for explicitly, instead
+	// of found through an author or collection page.
+	Explicit bool
+}
+
+// SmallestBooksFirst reorders the queue so the books asked for explicitly come
+// first, and then the rest, each smallest first by the total size of their files,
+// as given by size. The files of each book are kept together and in order. Books
+// with a file of unknown size, for which size returns a negative number, go last.
+func SmallestBooksFirst(queue []QueueItem, size func(QueueItem) int64) []QueueItem {
+	type book struct {
+		items    []QueueItem
+		size     int64
+		explicit bool
+	}
+	books := make([]*book, 0)
+	byKey := make(map[string]*book)
+
+	for _, item := range queue {
+		key := item.Dir + "\x00" + BookURLOf(item.URL).String()
+		b, ok := byKey[key]
+		if !ok {
+			b = &book{explicit: item.Explicit}
+			byKey[key] = b
+			books = append(books, b)
+		}
+		b.items = append(b.items, item)
+
+		itemSize := size(item)
+		if itemSize < 0 || b.size < 0 {
+			b.size = -1
+		} else {
+			b.size += itemSize
+		}
+	}
+
+	sort.SliceStable(books, func(i, j int) bool {
+		a, b := books[i], books[j]
+		switch {
+		case a.explicit != b.explicit:
+			return a.explicit
+		case (a.size < 0) != (b.size < 0):
+			return b.size < 0
+		default:
+			return a.size < b.size
+		}
+	})
+
+	sorted := make([]QueueItem, 0, len(queue))
+	for _, b := range books {
+		sorted = append(sorted, b.items...)
+	}
+
+	return sorted
+}
+
+// MaxStallRetries is how many times a download is retried after stalling, or after
+// getting something that is not an ebook.
+const MaxStallRetries = 2
+
+// SniffLength is the number of bytes at the start of a file needed by SniffEbook.
+const SniffLength = 68
+
+// NotEbookError is returned when a download turns out not to be an ebook file.
+type NotEbookError struct {
+	URL    *url.URL
+	Format string
+	// Head are the first bytes of what was got instead.
+	Head []byte
+}
+
+func (e *NotEbookError) Error() string {
+	return fmt.Sprintf("while downloading %s: doesn't look like %s, but starts with %q", e.URL, e.Format, e.Head)
+}
+
+// SniffEbook reports whether the first bytes of a file look like the given
+// format, e. g. to catch the HTML pages of captive portals, served with a 200
+// status. Unknown formats are always accepted.
+func SniffEbook(format string, head []byte) bool {
+	switch format {
+	case "epub", "kepub", "aepub":
+		// A zip file
+		return bytes.HasPrefix(head, []byte("PK\x03\x04"))
+	case "azw3":
+		// A Palm database of type BOOK and creator MOBI
+		return len(head) >= 68 && string(head[60:68]) == "BOOKMOBI"
+	default:
+		return true
+	}
+}
+
+// DownloaderOptions are the options that control how a Downloader saves files.
+type DownloaderOptions struct {
+	// Basedir is the directory where files are saved. It should already exist.
+	Basedir string
+	// FormatDirs maps a format name to the directory where files of that format
+	// are saved instead of Basedir. They should already exist.
+	FormatDirs map[string]string
+	// StagingDir, if not empty, is the directory where files are downloaded instead
+	// of their final place, under their directory relative to Basedir, leaving
+	// to the caller moving them there, e. g. with a Stager. It should already
+	// exist.
+	StagingDir string
+	// TempDir, if not empty, is the directory where files are downloaded, to be
+	// moved to their final place as soon as each one is complete, e. g. on a
+	// faster disk than the library, laid out like StagingDir. It's not used
+	// with StagingDir. It should already exist.
+	TempDir string
+	// RenameRules are applied, in order, to the name of every file saved.
+	RenameRules []RenameRule
+	// NoClobber refuses to download files whose final place already exists,
+	// instead of overwriting them.
+	NoClobber bool
+	// KeepVersions keeps the files that would be overwritten by a different
+	// version, with KeepVersion. It's left to the caller with StagingDir.
+	KeepVersions bool
+	// Resume keeps the .part files of failed downloads, and continues the ones
+	// left behind by interrupted runs with Range requests, if the server
+	// supports them and the file didn't change since.
+	Resume bool
+	// StallTimeout is how long a download can go without receiving any data
+	// before being aborted and retried. 0 disables the watchdog. It only covers
+	// the body; the wait for the response should be limited by the client, e. g.
+	// with the ResponseHeaderTimeout of its transport.
+	StallTimeout time.Duration
+}
+
+// Downloader downloads individual ebook files into a directory.
+//
+// The pacer will be used to peace HTTP connections with the provided client, in
+// the same way as with NormalizeURLs, and both can share the same pacer.
+//
+// Several files can be downloaded at once, e. g. with a DownloadPool.
+type Downloader struct {
+	client *http.Client
+	pacer  *Pacer
+	opts   DownloaderOptions
+
+	mu    sync.Mutex
+	stats DownloadStats
+}
+
+// NewDownloader creates a new Downloader.
+func NewDownloader(opts DownloaderOptions, pacer *Pacer, client *http.Client) *Downloader {
+	return &Downloader{
+		client: client,
+		pacer:  pacer,
+		opts:   opts,
+	}
+}
+
+// Stats returns statistics about every successful download so far.
+func (d *Downloader) Stats() DownloadStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.stats
+}
+
+// Filename returns the absolute filename where the file of the given item would
+// be saved.
+//
+// Advanced epubs are always given the "_advanced.epub" suffix, so they can't
+// overwrite the plain epub of the same book, before applying the RenameRules.
+func (d *Downloader) Filename(item QueueItem) string {
+	filename := path.Base(item.URL.Path)
+
+	format := item.Format
+	if format == "" {
+		format = FormatOf(item.URL.Path)
+	}
+
+	if format == "aepub" && !strings.HasSuffix(filename, "_advanced.epub") {
+		filename = strings.TrimSuffix(filename, ".epub") + "_advanced.epub"
+	}
+	filename = ApplyRenameRules(d.opts.RenameRules, filename)
+
+	dir := item.Dir
+	if dir == "" {
+		dir = d.opts.Basedir
+		if formatDir, ok := d.opts.FormatDirs[format]; ok {
+			dir = formatDir
+		}
+	}
+
+	return filepath.Join(dir, filename)
+}
+
+// Download downloads an individual ebook file, as returned by NormalizeURLs, and
+// returns the absolute filename where it was saved.
+//
+// Every file is downloaded into a .part file first, and only takes its place once
+// complete and known to be an ebook, so a failed download, or the page of a
+// captive portal, never replaces a good file.
+//
+// The item's Dir, if not empty, should already exist.
+func (d *Downloader) Download(item QueueItem) (string, error) {
+	ebookURL := StandardEbooksMainURL.ResolveReference(item.URL)
+	finalFilename := d.Filename(item)
+	if d.opts.NoClobber {
+		if _, err := os.Lstat(finalFilename); err == nil {
+			return finalFilename, fmt.Errorf("%s already exists, refusing to overwrite it", finalFilename)
+		}
+	}
+
+	// Files in the staging directory are moved by the caller, under their usual
+	// name
+	targetFilename := finalFilename
+	partFilename := finalFilename + ".part"
+	switch {
+	case d.opts.StagingDir != "":
+		targetFilename = d.workFilename(d.opts.StagingDir, finalFilename)
+		partFilename = targetFilename + ".part"
+	case d.opts.TempDir != "":
+		partFilename = d.workFilename(d.opts.TempDir, finalFilename) + ".part"
+	}
+	if partDir := filepath.Dir(partFilename); partDir != filepath.Dir(finalFilename) {
+		err := os.MkdirAll(partDir, os.ModePerm)
+		if err != nil {
+			return partFilename, err
+		}
+	}
+
+	// With Resume, a .part file left behind by an interrupted run is continued
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if d.opts.Resume {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+
+	f, err := os.OpenFile(partFilename, flags, 0666)
+	if err != nil {
+		return partFilename, err
+	}
+	defer f.Close()
+
+	var offset int64
+	if d.opts.Resume {
+		offset, err = resumeOffset(f)
+		if err != nil {
+			return partFilename, err
+		}
+	}
+
+	if offset > 0 {
+		log.Printf("resuming %s into %s from byte %d", ebookURL, partFilename, offset)
+	} else {
+		log.Printf("downloading %s to %s", ebookURL, partFilename)
+	}
+
+	format := item.Format
+	if format == "" {
+		format = FormatOf(item.URL.Path)
+	}
+
+	var n int64
+	var elapsed time.Duration
+	for retry := 0; ; retry++ {
+		var retryable bool
+		start := time.Now()
+		n, retryable, err = d.fetch(ebookURL, format, f, offset)
+		elapsed = time.Since(start)
+
+		if !retryable || retry >= MaxStallRetries {
+			break
+		}
+
+		log.Printf("%v, after %d bytes in %v; retrying", err, n, elapsed.Round(time.Millisecond))
+
+		// A stalled download is continued if possible, but anything else starts
+		// again from scratch
+		if _, ok := err.(*NotEbookError); !ok && d.opts.Resume {
+			offset, err = resumeOffset(f)
+		} else {
+			offset = 0
+			err = f.Truncate(0)
+		}
+		if err != nil {
+			return partFilename, err
+		}
+	}
+	if err != nil {
+		// Only an interrupted download of an ebook is worth resuming later
+		if _, ok := err.(*NotEbookError); ok || !d.opts.Resume {
+			f.Close()
+			os.Remove(partFilename)
+			os.Remove(partFilename + ResumeValidatorExt)
+		}
+		return partFilename, err
+	}
+
+	os.Remove(partFilename + ResumeValidatorExt)
+	err = f.Close()
+	if err != nil {
+		return partFilename, err
+	}
+
+	if d.opts.StagingDir != "" {
+		err = os.Rename(partFilename, targetFilename)
+		if err != nil {
+			return partFilename, err
+		}
+	} else {
+		if d.opts.KeepVersions {
+			err = KeepVersion(finalFilename, partFilename)
+			if err != nil {
+				return partFilename, err
+			}
+		}
+
+		move := MoveFile
+		if d.opts.NoClobber {
+			move = MoveNewFile
+		}
+		err = move(partFilename, finalFilename)
+		if err != nil {
+			return partFilename, err
+		}
+	}
+
+	log.Printf("downloaded %s: %d bytes in %v (%.1f KiB/s)", targetFilename, n, elapsed.Round(time.Millisecond), BytesPerSecond(n, elapsed)/1024)
+
+	d.mu.Lock()
+	d.stats.Files++
+	d.stats.Bytes += n
+	d.stats.Duration += elapsed
+	d.mu.Unlock()
+
+	return targetFilename, nil
+}
+
+// workFilename returns where a file whose final place is finalFilename is kept in
+// workDir, e. g. the staging directory, keeping its directory relative to
+// Basedir, so files with the same name headed for different directories don't
+// get mixed up. Directories outside Basedir are kept whole, under "_".
+func (d *Downloader) workFilename(workDir, finalFilename string) string {
+	dir := filepath.Dir(finalFilename)
+
+	rel, err := filepath.Rel(d.opts.Basedir, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = filepath.Join("_", strings.TrimPrefix(dir, filepath.VolumeName(dir)))
+	}
+
+	return filepath.Join(workDir, rel, filepath.Base(finalFilename))
+}
+
+// DownloadPool downloads queue items in the background with a Downloader, several
+// at once, and hands their results in the order they were started.
+type DownloadPool struct {
+	d       *Downloader
+	pending []chan downloadResult
+}
+
+// downloadResult is the result of a Download.
+type downloadResult struct {
+	filename string
+	err      error
+}
+
+// NewDownloadPool creates a new DownloadPool. How many downloads are going on at
+// once is up to the caller.
+func NewDownloadPool(d *Downloader) *DownloadPool {
+	return &DownloadPool{d: d}
+}
+
+// Start starts downloading item in the background.
+func (pool *DownloadPool) Start(item QueueItem) {
+	result := make(chan downloadResult, 1)
+	pool.pending = append(pool.pending, result)
+
+	go func() {
+		filename, err := pool.d.Download(item)
+		result <- downloadResult{filename: filename, err: err}
+	}()
+}
+
+// Pending returns the number of downloads started whose results were not taken
+// with Next yet.
+func (pool *DownloadPool) Pending() int {
+	return len(pool.pending)
+}
+
+// Next waits for the oldest download started, and returns its result as
+// Download would. It must not be called with no downloads pending.
+func (pool *DownloadPool) Next() (string, error) {
+	result := <-pool.pending[0]
+	pool.pending = pool.pending[1:]
+
+	return result.filename, result.err
+}
+
+// KeepVersion archives the existing file filename with ArchiveVersion, before
+// being replaced by newFilename, unless both have the same content.
+func KeepVersion(filename, newFilename string) error {
+	same, err := SameContent(filename, newFilename)
+	if os.IsNotExist(err) || same {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	archived, err := ArchiveVersion(filename)
+	if err != nil {
+		return err
+	}
+	log.Printf("kept the previous version of %s as %s", filename, archived)
+
+	return nil
+}
+
+// ArchiveVersion renames an existing file so a new version can take its place,
+// adding the date it was last modified before its extension, e. g.
+// "jane-austen_emma.2023-05-01.epub". A counter is added if that name is taken
+// too. It returns the new name, or "" if the file doesn't exist.
+func ArchiveVersion(filename string) (string, error) {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Extensions can be double, e. g. ".kepub.epub", while slugs have no dots
+	dir, base := filepath.Split(filename)
+	name, ext := base, ""
+	if i := strings.IndexByte(base, '.'); i > 0 {
+		name, ext = base[:i], base[i:]
+	}
+
+	date := info.ModTime().Format("2006-01-02")
+	archived := filepath.Join(dir, name+"."+date+ext)
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(archived); os.IsNotExist(err) {
+			break
+		}
+		archived = filepath.Join(dir, fmt.Sprintf("%s.%s-%d%s", name, date, i, ext))
+	}
+
+	return archived, os.Rename(filename, archived)
+}
+
+// FileStatus is the state of a file in the library compared with the one
+// upstream.
+type FileStatus int
+
+// Possible FileStatus values.
+const (
+	// FileUpToDate is a file present in the library, and not older than upstream.
+	FileUpToDate FileStatus = iota
+	// FileNew is a file not present in the library.
+	FileNew
+	// FileUpdated is a file present in the library, but older than upstream.
+	FileUpdated
+)
+
+// String returns the status in a human friendly form, e. g. "new".
+func (status FileStatus) String() string {
+	switch status {
+	case FileNew:
+		return "new"
+	case FileUpdated:
+		return "updated"
+	default:
+		return "up to date"
+	}
+}
+
+// Compare compares the file of an item in its final place with the one upstream,
+// as told by a HEAD request, without downloading anything.
+func (d *Downloader) Compare(item QueueItem) (FileStatus, error) {
+	info, err := os.Stat(d.Filename(item))
+	if os.IsNotExist(err) {
+		return FileNew, nil
+	}
+	if err != nil {
+		return FileUpToDate, err
+	}
+
+	resp, err := d.head(item)
+	if err != nil {
+		return FileUpToDate, err
+	}
+
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil && lastModified.After(info.ModTime()) {
+		return FileUpdated, nil
+	}
+
+	// Rename rules don't change the content, so sizes are still comparable
+	if resp.ContentLength >= 0 && resp.ContentLength != info.Size() {
+		return FileUpdated, nil
+	}
+
+	return FileUpToDate, nil
+}
+
+// Existing reports whether the file of item already exists in its final place, with
+// the same size as in the server. The server is only asked, with a HEAD request,
+// if the file exists.
+func (d *Downloader) Existing(item QueueItem) (bool, error) {
+	info, err := os.Stat(d.Filename(item))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := d.head(item)
+	if err != nil {
+		return false, err
+	}
+
+	return resp.ContentLength >= 0 && resp.ContentLength == info.Size(), nil
+}
+
+// Size returns the size of the file of item in the server, with a HEAD request,
+// or -1 if the server doesn't tell.
+func (d *Downloader) Size(item QueueItem) (int64, error) {
+	resp, err := d.head(item)
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.ContentLength, nil
+}
+
+// head makes a HEAD request for the file of item. The body of the response is
+// already closed.
+func (d *Downloader) head(item QueueItem) (*http.Response, error) {
+	ebookURL := StandardEbooksMainURL.ResolveReference(item.URL)
+	resp, release, err := d.pacer.Head(d.client, ebookURL.String())
+	defer release()
+	if err != nil {
+		return nil, fmt.Errorf("while checking %s: %v", ebookURL, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("while checking %s: unexpected response: %s", ebookURL, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// ResumeValidatorExt is the extension added to the name of a .part file for the
+// file next to it that keeps the ETag or Last-Modified of its download. Partial
+// downloads are only continued if the file didn't change in the server since.
+const ResumeValidatorExt = ".if-range"
+
+// resumeOffset returns the size of a partial download, from where it can be
+// continued, or truncates it and returns 0 if it can't, e. g. because there's no
+// validator to check that the file didn't change in the server.
+func resumeOffset(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := os.Stat(f.Name() + ResumeValidatorExt); err == nil && info.Size() > 0 {
+		return info.Size(), nil
+	}
+
+	return 0, f.Truncate(0)
+}
+
+// fetch makes a single attempt at downloading ebookURL, of the given format, into
+// f, from offset onwards if it's a partial download to resume. It returns the
+// number of bytes written, and reports whether the attempt failed in a way worth
+// retrying: because the stall watchdog aborted it, or because what was got is not
+// an ebook.
+func (d *Downloader) fetch(ebookURL *url.URL, format string, f *os.File, offset int64) (int64, bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The rest of a partial download, if it's still the same file
+	var header http.Header
+	if offset > 0 {
+		validator, err := ioutil.ReadFile(f.Name() + ResumeValidatorExt)
+		if err != nil {
+			return 0, false, err
+		}
+
+		header = http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		header.Set("If-Range", string(validator))
+	}
+
+	// A response that never starts is caught by the client's ResponseHeaderTimeout,
+	// and retried just like a stall
+	resp, release, err := d.pacer.GetWithHeader(ctx, d.client, ebookURL.String(), header)
+	defer release()
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return 0, true, fmt.Errorf("download of %s stalled: %v", ebookURL, err)
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("while getting %s: %v", ebookURL, err)
+	}
+	defer resp.Body.Close()
+
+	// Only armed now, so the wait for the pacer's turn doesn't count as a stall
+	var stalled int32
+	var watchdog *time.Timer
+	if d.opts.StallTimeout > 0 {
+		watchdog = time.AfterFunc(d.opts.StallTimeout, func() {
+			atomic.StoreInt32(&stalled, 1)
+			cancel()
+		})
+		defer watchdog.Stop()
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			return 0, false, err
+		}
+	case resp.StatusCode == http.StatusOK:
+		// A new download, or the server doesn't support ranges, or the file changed
+		if offset > 0 {
+			log.Printf("can't resume %s, downloading it again from the start", ebookURL)
+			offset = 0
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err == nil {
+			err = f.Truncate(0)
+		}
+		if err == nil && d.opts.Resume {
+			err = writeResumeValidator(f.Name(), resp)
+		}
+		if err != nil {
+			return 0, false, err
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// Most likely a partial file larger than the file in the server
+		os.Remove(f.Name() + ResumeValidatorExt)
+		return 0, true, fmt.Errorf("can't resume %s from byte %d: %s", ebookURL, offset, resp.Status)
+	default:
+		return 0, false, fmt.Errorf("while getting %s: unexpected response: %s", ebookURL, resp.Status)
+	}
+
+	var w io.Writer = f
+	var body io.Reader = resp.Body
+	if watchdog != nil {
+		body = &progressReader{
+			Reader:     resp.Body,
+			onProgress: func() { watchdog.Reset(d.opts.StallTimeout) },
+		}
+	}
+
+	// The start of a resumed download was already checked
+	var head []byte
+	var m int
+	if offset == 0 {
+		head = make([]byte, SniffLength)
+		m, err = io.ReadFull(body, head)
+		head = head[:m]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err == nil && !SniffEbook(format, head) {
+			return int64(m), true, &NotEbookError{URL: ebookURL, Format: format, Head: head}
+		}
+	}
+
+	var n int64
+	if err == nil {
+		_, err = w.Write(head)
+	}
+	if err == nil {
+		n, err = PooledCopy(w, body)
+	}
+	n += int64(m)
+	if atomic.LoadInt32(&stalled) == 1 {
+		return n, true, fmt.Errorf("download of %s stalled: no data for %v", ebookURL, d.opts.StallTimeout)
+	}
+	if err != nil {
+		return n, false, fmt.Errorf("while downloading %s: %v", ebookURL, err)
+	}
+
+	// The file is dated as upstream, so the outputs of a Converter, or the file
+	// itself with Compare, can be checked against it in later runs
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		err = os.Chtimes(f.Name(), lastModified, lastModified)
+		if err != nil {
+			return n, false, err
+		}
+	}
+
+	return n, false, nil
+}
+
+// writeResumeValidator keeps the ETag, or else the Last-Modified, of the response
+// for the download into filename, so it can be resumed with an If-Range request.
+// Without either, it can't.
+func writeResumeValidator(filename string, resp *http.Response) error {
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	if validator == "" {
+		err := os.Remove(filename + ResumeValidatorExt)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return ioutil.WriteFile(filename+ResumeValidatorExt, []byte(validator), 0666)
+}
+
+// progressReader calls a function every time some data is read.
+type progressReader struct {
+	io.Reader
+	onProgress func()
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.Reader.Read(p)
+	if n > 0 {
+		pr.onProgress()
+	}
+
+	return n, err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables that can set flags.
+const EnvPrefix = "SESCRP_"
+
+// EnvName returns the name of the environment variable for a given flag, e. g.
+// "SESCRP_CONNECTION_WAIT" for "connection-wait".
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// ApplyEnvironment sets every flag not explicitly given in the command line from
+// its environment variable, if present. It must be called after flag.Parse, so
+// flags always take priority over the environment.
+func ApplyEnvironment() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+
+		value, ok := os.LookupEnv(EnvName(f.Name))
+		if !ok {
+			return
+		}
+
+		setErr := flag.Set(f.Name, value)
+		if setErr != nil {
+			err = fmt.Errorf("invalid value \"%s\" for %s: %v", value, EnvName(f.Name), setErr)
+		}
+	})
+
+	return err
+}
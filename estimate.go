@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// LongRunWarning is the minimum time spent only in waits between connections
+// above which a run is warned about before starting to download.
+const LongRunWarning = time.Hour
+
+// RunEstimate is an estimate of the load a run will put on the server, and of
+// the time it will take at the least.
+type RunEstimate struct {
+	// Requests is the number of HTTP requests to make.
+	Requests int
+	// Pacing is the time spent only in waits between connections, not counting the
+	// time of the connections themselves. It grows if the server pushes back.
+	Pacing time.Duration
+}
+
+// EstimateRun estimates a run of the given number of requests with the given
+// wait between them.
+func EstimateRun(requests int, wait time.Duration) RunEstimate {
+	estimate := RunEstimate{Requests: requests}
+	if requests > 1 {
+		estimate.Pacing = time.Duration(requests-1) * wait
+	}
+
+	return estimate
+}
+
+// String returns the estimate in a human friendly form, e. g. "412 requests ≈ 7m
+// of pacing plus transfer time".
+func (estimate RunEstimate) String() string {
+	return fmt.Sprintf("%d requests ≈ %v of pacing plus transfer time", estimate.Requests, estimate.Pacing.Round(time.Second))
+}
+
+// CountInputKinds counts the book pages and the author or collection pages among
+// the given URLs. The latter will also need a request for each of their books.
+func CountInputKinds(inputs []Input) (books, indexes int) {
+	for _, input := range inputs {
+		switch PageKindOf(input.URL) {
+		case BookPageKind:
+			books++
+		case AuthorPageKind, CollectionPageKind:
+			indexes++
+		}
+	}
+
+	return books, indexes
+}
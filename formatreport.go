@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// archivedVersionRegex matches the date added by ArchiveVersion to the name of a
+// book, e. g. the ".2023-05-01" of "jane-austen_emma.2023-05-01".
+var archivedVersionRegex = regexp.MustCompile(`\.\d{4}-\d{2}-\d{2}(-\d+)?$`)
+
+// LibraryBook is a book found in the library, with its files in every format.
+type LibraryBook struct {
+	// Name is the name of its files without the format suffix, e. g.
+	// "jane-austen_emma".
+	Name string
+	// Files maps the formats found to their filenames.
+	Files map[string]string
+}
+
+// Formats returns the sorted formats of the book found in the library.
+func (book *LibraryBook) Formats() []string {
+	formats := make([]string, 0, len(book.Files))
+	for format := range book.Files {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+
+	return formats
+}
+
+// ScanLibrary finds the ebook files in the given directories and their
+// subdirectories, and groups them by book, sorted by name.
+//
+// Files are recognized by the names Standard Ebooks gives them, including the
+// ".kepub" of -trim-kepub; files renamed by other rules, and versions kept by
+// -keep-versions, are ignored.
+func ScanLibrary(dirs []string) ([]*LibraryBook, error) {
+	books := make(map[string]*LibraryBook)
+	seen := make(map[string]bool)
+
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// Format directories may be inside the base directory
+			if info.IsDir() || seen[filename] {
+				return nil
+			}
+			seen[filename] = true
+
+			name, format := splitFormat(filepath.Base(filename))
+			if format == "" || archivedVersionRegex.MatchString(name) {
+				return nil
+			}
+
+			book, ok := books[name]
+			if !ok {
+				book = &LibraryBook{Name: name, Files: make(map[string]string)}
+				books[name] = book
+			}
+			book.Files[format] = filename
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sorted := make([]*LibraryBook, 0, len(books))
+	for _, book := range books {
+		sorted = append(sorted, book)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	return sorted, nil
+}
+
+// splitFormat splits a filename into the name of its book and its format, or
+// returns an empty format if it's not an ebook file.
+func splitFormat(filename string) (string, string) {
+	if strings.HasSuffix(filename, ".kepub") {
+		return strings.TrimSuffix(filename, ".kepub"), "kepub"
+	}
+
+	switch format := FormatOf(filename); format {
+	case "aepub":
+		return strings.TrimSuffix(filename, "_advanced.epub"), format
+	case "kepub":
+		return strings.TrimSuffix(filename, ".kepub.epub"), format
+	case "":
+		return filename, ""
+	default:
+		return strings.TrimSuffix(filename, "."+format), format
+	}
+}
+
+// PrintFormatReport prints the books found in more than one format, and flags the
+// ones with formats that are not wanted, e. g. an azw3 when only epub is. It
+// returns the exit code: 1 if any book was flagged, 0 otherwise.
+func PrintFormatReport(w io.Writer, books []*LibraryBook, wanted []string) int {
+	isWanted := make(map[string]bool)
+	for _, format := range wanted {
+		isWanted[format] = true
+	}
+
+	multiple := 0
+	flagged := 0
+	for _, book := range books {
+		formats := book.Formats()
+
+		unwanted := make([]string, 0)
+		for _, format := range formats {
+			if !isWanted[format] {
+				unwanted = append(unwanted, format)
+			}
+		}
+
+		if len(formats) < 2 && len(unwanted) == 0 {
+			continue
+		}
+		if len(formats) > 1 {
+			multiple++
+		}
+
+		if len(unwanted) > 0 {
+			flagged++
+			fmt.Fprintf(w, "[unwanted] %s: %s (not wanted: %s)\n", book.Name, strings.Join(formats, ","), strings.Join(unwanted, ","))
+			for _, format := range unwanted {
+				fmt.Fprintf(w, "    %s\n", book.Files[format])
+			}
+		} else {
+			fmt.Fprintf(w, "[ok] %s: %s\n", book.Name, strings.Join(formats, ","))
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d books, %d in more than one format, %d with unwanted formats (wanted: %s)\n", len(books), multiple, flagged, strings.Join(wanted, ","))
+
+	if flagged > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// InputOptions are the options that can be overridden for some of the inputs,
+// e. g. in the lines of an -in file. Empty fields keep the global value.
+type InputOptions struct {
+	// Formats replaces the -formats flag.
+	Formats string
+	// Dir replaces the -dir flag, and any -format-dir. If relative, it's taken
+	// from -dir.
+	Dir string
+}
+
+// String returns the options in the format of an -in file, e. g.
+// "formats=epub dir=SciFi".
+func (opts InputOptions) String() string {
+	fields := make([]string, 0, 2)
+	if opts.Formats != "" {
+		fields = append(fields, "formats="+opts.Formats)
+	}
+	if opts.Dir != "" {
+		fields = append(fields, "dir="+opts.Dir)
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// override returns these options with the non-empty fields of other replacing
+// their own.
+func (opts InputOptions) override(other InputOptions) InputOptions {
+	if other.Formats != "" {
+		opts.Formats = other.Formats
+	}
+	if other.Dir != "" {
+		opts.Dir = other.Dir
+	}
+
+	return opts
+}
+
+// Input is a URL to process, together with its options.
+type Input struct {
+	URL     string
+	Options InputOptions
+}
+
+// ParseInputOptions parses space-separated "key=value" fields. The valid keys are
+// "formats" and "dir".
+func ParseInputOptions(fields []string) (InputOptions, error) {
+	var opts InputOptions
+
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return opts, fmt.Errorf("expected key=value, got \"%s\"", field)
+		}
+
+		switch parts[0] {
+		case "formats":
+			opts.Formats = parts[1]
+		case "dir":
+			opts.Dir = parts[1]
+		default:
+			return opts, fmt.Errorf("unknown option \"%s\"", parts[0])
+		}
+	}
+
+	return opts, nil
+}
+
+// ReadInputList reads inputs in the format of the -in flag:
+//
+//	# Comments start with a hash, and are ignored along with empty lines
+//	https://standardebooks.org/ebooks/jane-austen/emma
+//
+//	# URLs can be shortened as with ExpandShorthand
+//	jane-austen/persuasion
+//
+//	# Options after a URL apply only to it
+//	https://standardebooks.org/ebooks/h-g-wells formats=epub dir=SciFi
+//
+//	# A line with only options applies them to the following lines, up to the
+//	# next empty line
+//	formats=kepub dir=Kobo
+//	https://standardebooks.org/ebooks/jules-verne
+//	https://standardebooks.org/ebooks/mary-shelley/frankenstein
+func ReadInputList(r io.Reader) ([]Input, error) {
+	inputs := make([]Input, 0)
+	var groupOpts InputOptions
+
+	scanner := bufio.NewScanner(bufio.NewReader(r))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			// Only really empty lines end a group, not comments
+			if strings.TrimSpace(scanner.Text()) == "" {
+				groupOpts = InputOptions{}
+			}
+			continue
+		}
+
+		if strings.Contains(fields[0], "=") && !strings.Contains(fields[0], "://") {
+			opts, err := ParseInputOptions(fields)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+
+			groupOpts = opts
+			continue
+		}
+
+		opts, err := ParseInputOptions(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+
+		inputs = append(inputs, Input{
+			URL:     fields[0],
+			Options: groupOpts.override(opts),
+		})
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return inputs, nil
+}
+
+// ReadInputFile reads the inputs in a file with ReadInputList. A filename of "-"
+// reads the standard input.
+func ReadInputFile(filename string) ([]Input, error) {
+	var r io.Reader = os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	inputs, err := ReadInputList(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return inputs, nil
+}
+
+// WriteInputList writes inputs to a file in the format read by ReadInputList,
+// with their options on the same line.
+func WriteInputList(filename string, inputs []Input) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = PrintInputList(f, inputs)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// PrintInputList writes inputs to w like WriteInputList.
+func PrintInputList(w io.Writer, inputs []Input) error {
+	bw := bufio.NewWriter(w)
+	for _, input := range inputs {
+		fmt.Fprintln(bw, strings.TrimSpace(input.URL+" "+input.Options.String()))
+	}
+
+	return bw.Flush()
+}
+
+// InputGroup is a set of URLs that share the same options.
+type InputGroup struct {
+	Options InputOptions
+	URLs    []string
+}
+
+// GroupInputs groups the inputs by their options, keeping the order in which each
+// set of options first appears, and the order of the URLs in each group.
+func GroupInputs(inputs []Input) []InputGroup {
+	groups := make([]InputGroup, 0, 1)
+	index := make(map[InputOptions]int)
+
+	for _, input := range inputs {
+		i, ok := index[input.Options]
+		if !ok {
+			i = len(groups)
+			index[input.Options] = i
+			groups = append(groups, InputGroup{Options: input.Options})
+		}
+
+		groups[i].URLs = append(groups[i].URLs, input.URL)
+	}
+
+	return groups
+}
+
+// BookInputs returns the pages of the books the queued files belong to, keeping
+// their options, without repeats. They can be written with WriteInputList to get
+// the books again later.
+func BookInputs(items []QueueItem) []Input {
+	inputs := make([]Input, 0, len(items))
+	seen := make(map[Input]struct{}, len(items))
+	for _, item := range items {
+		input := Input{
+			URL:     StandardEbooksMainURL.ResolveReference(BookURLOf(item.URL)).String(),
+			Options: item.Options,
+		}
+
+		if _, ok := seen[input]; !ok {
+			inputs = append(inputs, input)
+			seen[input] = struct{}{}
+		}
+	}
+
+	return inputs
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// IPFSClient adds files to an IPFS node through its HTTP RPC API, e. g. the one
+// of a local Kubo daemon at "http://127.0.0.1:5001".
+type IPFSClient struct {
+	api    *url.URL
+	client *http.Client
+}
+
+// NewIPFSClient creates a new IPFSClient for the node whose API is at apiURL.
+func NewIPFSClient(apiURL string, client *http.Client) (*IPFSClient, error) {
+	api, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, err
+	}
+	if api.Scheme != "http" && api.Scheme != "https" {
+		return nil, fmt.Errorf("the IPFS API URL should be http or https, got \"%s\"", apiURL)
+	}
+
+	return &IPFSClient{
+		api:    api,
+		client: client,
+	}, nil
+}
+
+// Add adds and pins a file in the node, and returns its CID.
+func (ipfs *IPFSClient) Add(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// The file is streamed into the request, instead of loading it into memory
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", filepath.Base(filename))
+		if err == nil {
+			_, err = PooledCopy(part, f)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	addURL := ipfs.api.ResolveReference(&url.URL{Path: "/api/v0/add", RawQuery: "pin=true&cid-version=1"})
+	resp, err := ipfs.client.Post(addURL.String(), mw.FormDataContentType(), pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return "", fmt.Errorf("while adding %s to IPFS: %v", filename, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("while adding %s to IPFS: unexpected response: %s", filename, resp.Status)
+	}
+
+	var added struct {
+		Hash string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&added)
+	if err != nil {
+		return "", fmt.Errorf("while adding %s to IPFS: %v", filename, err)
+	}
+	if added.Hash == "" {
+		return "", fmt.Errorf("while adding %s to IPFS: no CID in the response", filename)
+	}
+
+	return added.Hash, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"golang.org/x/net/html"
+)
+
+// IndexLayout is a set of rules to find the books listed in author and collection
+// pages, for one of the layouts Standard Ebooks has used for them.
+type IndexLayout struct {
+	// Name identifies the layout, e. g. for the -layout flag.
+	Name string
+	// Detect reports whether a parsed page uses this layout.
+	Detect func(doc *html.Node) bool
+	// BookLink reports whether an <a> element is a link to one of the books
+	// listed.
+	BookLink func(a *html.Node) bool
+}
+
+// IndexLayouts are the known layouts, in the order they're tried by
+// DetectIndexLayout. The last one is used if no other is detected.
+var IndexLayouts = []*IndexLayout{
+	{
+		// Books marked up as schema.org items, e. g.
+		// <li typeof="schema:Book"><a href="/ebooks/...">
+		Name: "rdfa",
+		Detect: func(doc *html.Node) bool {
+			return findNode(doc, isBookItem) != nil
+		},
+		BookLink: func(a *html.Node) bool {
+			// Only links to the book itself, not e. g. to its author
+			href, err := url.Parse(attrValue(a, "href"))
+			if err != nil || PageKindOf(StandardEbooksMainURL.ResolveReference(href).String()) != BookPageKind {
+				return false
+			}
+
+			for n := a.Parent; n != nil; n = n.Parent {
+				if isBookItem(n) {
+					return true
+				}
+			}
+
+			return false
+		},
+	},
+	{
+		// Links inside a <p> with no attributes, which is inside a <li>
+		Name: "classic",
+		Detect: func(doc *html.Node) bool {
+			return true
+		},
+		BookLink: func(a *html.Node) bool {
+			return a.Parent.Type == html.ElementNode && a.Parent.Data == "p" && len(a.Parent.Attr) == 0 && a.Parent.Parent.Type == html.ElementNode && a.Parent.Parent.Data == "li"
+		},
+	},
+}
+
+// IndexLayoutNames returns the names of all known layouts.
+func IndexLayoutNames() []string {
+	names := make([]string, 0, len(IndexLayouts))
+	for _, layout := range IndexLayouts {
+		names = append(names, layout.Name)
+	}
+
+	return names
+}
+
+// IndexLayoutByName returns the layout with the given name.
+func IndexLayoutByName(name string) (*IndexLayout, error) {
+	for _, layout := range IndexLayouts {
+		if layout.Name == name {
+			return layout, nil
+		}
+	}
+
+	return nil, fmt.Errorf("the layout \"%s\" is not supported", name)
+}
+
+// DetectIndexLayout returns the first layout detected in a parsed page.
+func DetectIndexLayout(doc *html.Node) *IndexLayout {
+	for _, layout := range IndexLayouts {
+		if layout.Detect(doc) {
+			return layout
+		}
+	}
+
+	return IndexLayouts[len(IndexLayouts)-1]
+}
+
+// isBookItem reports whether n is an element marked up as a schema.org book.
+func isBookItem(n *html.Node) bool {
+	return n.Type == html.ElementNode && attrValue(n, "typeof") == "schema:Book"
+}
+
+// attrValue returns the value of an attribute of n, or "" if it doesn't have it.
+func attrValue(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+
+	return ""
+}
+
+// findNode returns the first node, in depth-first order, for which match is true.
+func findNode(n *html.Node, match func(*html.Node) bool) *html.Node {
+	if match(n) {
+		return n
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findNode(c, match); found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an io.Writer appending to a log file, which is rotated once it
+// grows over a maximum size: "sescrp.log" is renamed to "sescrp.log.1", the
+// previous "sescrp.log.1" to "sescrp.log.2", and so on, and the oldest ones over
+// the number to keep are deleted.
+//
+// It's safe for concurrent use, as required by log.SetOutput.
+type RotatingFile struct {
+	filename string
+	maxSize  int64
+	keep     int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens, or creates, the log file filename for appending.
+//
+// maxSize is the size in bytes over which the file is rotated, or 0 to never
+// rotate it, and keep the number of rotated files to keep.
+func OpenRotatingFile(filename string, maxSize int64, keep int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		filename: filename,
+		maxSize:  maxSize,
+		keep:     keep,
+	}
+
+	err := rf.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+// open opens the current log file.
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.f = f
+	rf.size = info.Size()
+
+	return nil
+}
+
+// Write writes p to the log file, rotating it first if p would take it over the
+// maximum size. A single write is never split between files.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		err := rf.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+// rotate shifts the rotated files, deleting the oldest, and starts a new log file.
+func (rf *RotatingFile) rotate() error {
+	err := rf.f.Close()
+	if err != nil {
+		return err
+	}
+
+	if rf.keep <= 0 {
+		err = os.Remove(rf.filename)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", rf.filename, rf.keep))
+		for i := rf.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.filename, i), fmt.Sprintf("%s.%d", rf.filename, i+1))
+		}
+		err = os.Rename(rf.filename, rf.filename+".1")
+	}
+	if err != nil {
+		return err
+	}
+
+	return rf.open()
+}
+
+// Close closes the current log file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.f.Close()
+}
@@ -1,201 +1,547 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
-	"time"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-// URLSet is a set of *url.URLs, without repeats.
+// URLSet is a set of *url.URLs, without repeats, that remembers the order in
+// which they were added.
 type URLSet struct {
-	set map[string]*url.URL
+	// formats has the string form of every URL in the set, mapped to its format,
+	// or to "" if it's to be deduced from its file name. A single map keeps the
+	// string form from being computed more than once per URL added.
+	formats map[string]string
+	urls    []*url.URL
 }
 
 // NewURLSet creates a new URLSet.
-func NewURLSet() *URLSet {
+//
+// sizeHint is the number of URLs expected to be added, so the set can be
+// allocated once for big crawls; 0 is fine if it's unknown.
+func NewURLSet(sizeHint int) *URLSet {
 	return &URLSet{
-		set: make(map[string]*url.URL),
+		formats: make(map[string]string, sizeHint),
+		urls:    make([]*url.URL, 0, sizeHint),
 	}
 }
 
 // Add adds the given URLs into the set, hopefully eliminating repeats as it goes.
+//
+// URLs already in the set are kept as they are, so the first *url.URL added for
+// a given string form is the one that will be returned by ToSlice.
 func (uset *URLSet) Add(urls ...*url.URL) {
 	for _, u := range urls {
-		uset.set[u.String()] = u
+		uset.add(u.String(), u)
 	}
 }
 
-// ToSlice returns all the elements of the set in the form of a slice
-func (uset *URLSet) ToSlice() []*url.URL {
-	uslice := make([]*url.URL, 0, len(uset.set))
-	for _, u := range uset.set {
-		uslice = append(uslice, u)
+// AddFormat is like Add, but also records the format of the URLs, for when it
+// can't be deduced from their file names.
+func (uset *URLSet) AddFormat(format string, urls ...*url.URL) {
+	for _, u := range urls {
+		key := u.String()
+		uset.add(key, u)
+		uset.formats[key] = format
 	}
+}
+
+// add adds u, whose string form is key, if it's not in the set yet.
+func (uset *URLSet) add(key string, u *url.URL) {
+	if _, ok := uset.formats[key]; !ok {
+		uset.formats[key] = ""
+		uset.urls = append(uset.urls, u)
+	}
+}
+
+// Format returns the format of one of the URLs in the set, as recorded by
+// AddFormat or, failing that, deduced from its file name.
+func (uset *URLSet) Format(u *url.URL) string {
+	if format := uset.formats[u.String()]; format != "" {
+		return format
+	}
+
+	return FormatOf(u.Path)
+}
+
+// Len returns the number of URLs in the set.
+func (uset *URLSet) Len() int {
+	return len(uset.urls)
+}
+
+// ToSlice returns all the elements of the set in the form of a slice, in the
+// order they were first added.
+func (uset *URLSet) ToSlice() []*url.URL {
+	uslice := make([]*url.URL, len(uset.urls))
+	copy(uslice, uset.urls)
 
 	return uslice
 }
 
+// NormalizeOptions are the options that control how NormalizeURLs resolves URLs.
+type NormalizeOptions struct {
+	// Formats is a comma-separated list of the formats to look for, as accepted by
+	// NewEbookPageParser.
+	Formats string
+	// Crawl, if not nil, limits the number of books that author and collection
+	// pages may add to the crawl. It's a pointer so every call to NormalizeURLs of
+	// a run can share the same limit.
+	Crawl *CrawlBudget
+	// MinWords and MaxWords restrict the books to those with a word count in that
+	// range. 0 means no limit. Books whose word count can't be found are never
+	// excluded.
+	MinWords, MaxWords int
+	// Fallbacks maps a format to the ones to get instead, in order of preference,
+	// for books that lack it, as returned by ParseFallbacks.
+	Fallbacks map[string][]string
+	// FallbackEpub gets the plain epub of books that lack any of the requested
+	// formats, as a last resort after Fallbacks.
+	FallbackEpub bool
+	// Layout, if not nil, is the layout of author and collection pages to use,
+	// instead of detecting it in each page.
+	Layout *IndexLayout
+	// MaxPageSize is the size in bytes over which pages are refused instead of
+	// parsed, as with ReadPage. 0 means no limit.
+	MaxPageSize int64
+	// KeepGoing records pages that can't be got or parsed as Failures in the
+	// report, and goes on with the rest, instead of stopping at the first one.
+	KeepGoing bool
+	// Concurrency is the number of book pages of an author or collection page got
+	// at once, with their connections overlapping only if the Pacer allows it, as
+	// set with SetOverlapping. Under 2, they're got one at a time.
+	Concurrency int
+}
+
+// CrawlBudget counts the books that author and collection pages add to a crawl,
+// and asks for confirmation once there are too many, e. g. to avoid accidental
+// full-site scrapes.
+type CrawlBudget struct {
+	// MaxBooks is the number of books that may be added, all together, before
+	// asking for confirmation. 0 means no limit.
+	MaxBooks int
+	// Confirm is called when MaxBooks is exceeded, with the URL that exceeded it
+	// and the total number of books in the crawl so far. The crawl only goes on if
+	// it returns true, and it's not asked again. If nil, the crawl is aborted.
+	Confirm func(rawURL string, books int) bool
+
+	books     int
+	confirmed bool
+}
+
+// Add adds the books found in the page rawURL to the crawl, returning an error if
+// that takes it over MaxBooks without confirmation.
+func (budget *CrawlBudget) Add(rawURL string, books int) error {
+	budget.books += books
+	if budget.confirmed || budget.MaxBooks <= 0 || budget.books <= budget.MaxBooks {
+		return nil
+	}
+
+	if budget.Confirm == nil || !budget.Confirm(rawURL, budget.books) {
+		return fmt.Errorf("%s takes the crawl to %d books, more than the maximum of %d", rawURL, budget.books, budget.MaxBooks)
+	}
+	budget.confirmed = true
+
+	return nil
+}
+
+// ParseFallbacks parses fallback chains like "kepub>epub", where each format is
+// followed by the ones to get in its place if a book doesn't offer it, in order of
+// preference. Several chains can be given separated by commas, e. g.
+// "kepub>epub,azw3>epub".
+func ParseFallbacks(chains string) (map[string][]string, error) {
+	fallbacks := make(map[string][]string)
+
+	for _, chain := range strings.Split(chains, ",") {
+		formats := strings.Split(strings.TrimSpace(chain), ">")
+		if len(formats) < 2 {
+			return nil, fmt.Errorf("expected a chain like \"kepub>epub\", got \"%s\"", chain)
+		}
+
+		for i, format := range formats {
+			format = strings.TrimSpace(format)
+			if _, ok := FormatsTesters[format]; !ok {
+				return nil, fmt.Errorf("the extension \"%s\" is not supported", format)
+			}
+			formats[i] = format
+		}
+
+		if _, ok := fallbacks[formats[0]]; ok {
+			return nil, fmt.Errorf("more than one fallback chain for \"%s\"", formats[0])
+		}
+		fallbacks[formats[0]] = formats[1:]
+	}
+
+	return fallbacks, nil
+}
+
+// wordCountAllowed checks a word count against MinWords and MaxWords.
+func (opts NormalizeOptions) wordCountAllowed(words int) bool {
+	if words == 0 {
+		return true
+	}
+
+	return (opts.MinWords <= 0 || words >= opts.MinWords) && (opts.MaxWords <= 0 || words <= opts.MaxWords)
+}
+
+// NormalizeReport collects what was found while normalizing that is worth telling
+// the user, but is not an error.
+type NormalizeReport struct {
+	// Removed are the book pages found through author or collection pages that
+	// no longer exist upstream (404 or 410), e. g. withdrawn books.
+	Removed []string
+	// Unavailable are the requested formats some books don't offer.
+	Unavailable []UnavailableFormat
+	// Warnings are problems found in pages that didn't stop them from being
+	// processed, e. g. unparseable links.
+	Warnings []string
+	// Failures are what failed with KeepGoing. The caller may add its own, e. g.
+	// for downloads.
+	Failures []Failure
+}
+
+// Failure is something that failed in a run that went on with the rest.
+type Failure struct {
+	// URL is the page or file that failed.
+	URL string
+	// Phase is what was being done with it, e. g. "classify", "fetch", "parse"
+	// or "download".
+	Phase string
+	// Err is what went wrong.
+	Err error
+}
+
+// UnavailableFormat is a format a book doesn't offer.
+type UnavailableFormat struct {
+	// Book is the URL of the book page.
+	Book string
+	// Format is the missing format.
+	Format string
+	// Fallback is the format downloaded instead, if any.
+	Fallback string
+}
+
+// Merge adds everything in other to the report.
+func (report *NormalizeReport) Merge(other *NormalizeReport) {
+	report.Removed = append(report.Removed, other.Removed...)
+	report.Unavailable = append(report.Unavailable, other.Unavailable...)
+	report.Warnings = append(report.Warnings, other.Warnings...)
+	report.Failures = append(report.Failures, other.Failures...)
+}
+
 // NormalizeURLs receives a slice of URLs in string form, detect whether they're
 // from an individual ebook, author or a collection, applies the appropiate parser,
-// and returns an *URLSet of the individual ebook files.
+// and returns an *URLSet of the individual ebook files, together with a report of
+// anything notable found along the way.
+//
+// Individual ebook URLs are processed first, so the files of the books explicitly
+// asked for come before the ones found through author or collection pages, and
+// will be the first to be downloaded.
 //
-// The timer will be used to peace HTTP connections with the provided client.
-// Before each connection, the timer will be waited for, and reset with the
-// given duration after the body of the response has been read. The timer should
-// have been properly initialized before calling this function, even if with an
-// initial wait time of 0.
+// The pacer will be used to peace HTTP connections with the provided client.
+// Each connection waits for its turn, and the pacer is released after the body of
+// the response has been read.
 //
 // All URLs returned are relative to the StandardEbooks main url.
-func NormalizeURLs(rawURLs []string, formats string, connectionWait time.Duration, timer *time.Timer, client *http.Client) (*URLSet, error) {
+func NormalizeURLs(rawURLs []string, opts NormalizeOptions, pacer *Pacer, client *http.Client) (*URLSet, *NormalizeReport, error) {
 	// Eliminate repeats in the raw URLs
 	rawURLs = RemoveStringDuplicates(rawURLs)
 
-	finalURLs := NewURLSet()
+	// Explicitly requested books first, keeping the relative order otherwise
+	sort.SliceStable(rawURLs, func(i, j int) bool {
+		return PageKindOf(rawURLs[i]) == BookPageKind && PageKindOf(rawURLs[j]) != BookPageKind
+	})
 
-	ebookParser, err := NewEbookPageParser(formats)
+	// Every ebook page yields about one URL per format
+	finalURLs := NewURLSet(len(rawURLs) * len(FormatsTesters))
+	report := &NormalizeReport{}
+
+	ebookParser, err := NewEbookPageParser(opts.Formats)
 	if err != nil {
-		return finalURLs, fmt.Errorf("while creating EbookPageParser: %v", err)
+		return finalURLs, report, fmt.Errorf("while creating EbookPageParser: %v", err)
 	}
 	collectionParser := NewCollectionPageParser()
+	collectionParser.Layout = opts.Layout
 	authorParser := NewAuthorPageParser()
+	authorParser.Layout = opts.Layout
 
-	for _, rawURL := range rawURLs {
-		// Check if the URL is from StandardEbooks at all
-		if !StandardEbooksMainRegex.MatchString(rawURL) {
-			return finalURLs, fmt.Errorf("%s is not a valid StandardEbook book", rawURL)
+	// With KeepGoing, records a failure and returns nil so the caller goes on;
+	// otherwise, returns err as is
+	fail := func(rawURL string, phase string, err error) error {
+		if !opts.KeepGoing || err == nil {
+			return err
 		}
 
-		if EbookURLRegex.MatchString(rawURL) { // A single ebook
-			err = func() error {
-				<-timer.C
+		log.Printf("error: %v; going on with the rest", err)
+		report.Failures = append(report.Failures, Failure{URL: rawURL, Phase: phase, Err: err})
+		return nil
+	}
+
+	// Turns the links skipped by a parser into warnings, returning any other error
+	softFail := func(pageURL string, err error) error {
+		if skipped, ok := err.(HrefErrors); ok {
+			log.Printf("warning: %s: %v", pageURL, skipped)
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s: %v", pageURL, skipped))
+			return nil
+		}
 
-				resp, err := client.Get(rawURL)
-				if err != nil {
-					return fmt.Errorf("while getting %s: %v", rawURL, err)
-				}
-				defer resp.Body.Close()
+		return err
+	}
 
-				urls, err := ebookParser.Parse(resp.Body)
-				if err != nil {
-					return fmt.Errorf("while parsing %s: %v", rawURL, err)
-				}
+	// Gets the page of an individual ebook, returning its body and the URL it was
+	// finally got from, after any redirect. A nil body means the book was removed,
+	// which is left to the caller to report.
+	//
+	// Books asked for explicitly are never taken as removed, as a mistyped URL is
+	// more likely.
+	fetchBook := func(bookURL string, explicit bool) ([]byte, *url.URL, error) {
+		resp, release, err := pacer.Get(client, bookURL)
+		defer release()
+		if err != nil {
+			return nil, nil, fmt.Errorf("while getting %s: %v", bookURL, err)
+		}
+		defer resp.Body.Close()
+
+		switch {
+		case explicit && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone):
+			return nil, nil, fmt.Errorf("while getting %s: %s; check the URL", bookURL, resp.Status)
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			log.Printf("%s was removed upstream (%s)", bookURL, resp.Status)
+			return nil, nil, nil
+		case resp.StatusCode != http.StatusOK:
+			return nil, nil, fmt.Errorf("while getting %s: unexpected response: %s", bookURL, resp.Status)
+		}
 
-				finalURLs.Add(urls...)
+		body, err := ReadPage(resp, opts.MaxPageSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("while getting %s: %v", bookURL, err)
+		}
 
-				timer.Reset(connectionWait)
+		return body, resp.Request.URL, nil
+	}
 
-				return nil
-			}()
-			if err != nil {
-				return finalURLs, err
-			}
+	// Adds the files of a parsed ebook page
+	seenBooks := make(map[string]struct{})
+	addBook := func(bookURL string, finalURL *url.URL, book *BookPage) {
+		// Books whose slug changed are redirected, and the page itself names its
+		// canonical URL. Either way, the same book is only processed once.
+		canonicalURL := finalURL
+		if book.CanonicalURL != nil {
+			canonicalURL = canonicalURL.ResolveReference(book.CanonicalURL)
+		}
+		canonical := strings.TrimSuffix(canonicalURL.String(), "/")
+		if canonical != strings.TrimSuffix(bookURL, "/") {
+			log.Printf("%s has moved to %s", bookURL, canonical)
+		}
+		if _, ok := seenBooks[canonical]; ok {
+			return
+		}
+		seenBooks[canonical] = struct{}{}
 
-		} else if CollectionURLRegex.MatchString(rawURL) { // A collection of ebooks
-			err = func() error {
-				// First getting the individual books
-				<-timer.C
+		if !opts.wordCountAllowed(book.WordCount) {
+			log.Printf("skipping %s: %d words is out of the requested range", bookURL, book.WordCount)
+			return
+		}
 
-				resp, err := client.Get(rawURL)
-				if err != nil {
-					return fmt.Errorf("while getting %s: %v", rawURL, err)
-				}
-				defer resp.Body.Close()
+		for _, fileURL := range book.FileURLs {
+			finalURLs.AddFormat(book.FormatOf(fileURL), fileURL)
+		}
 
-				booksURLs, err := collectionParser.Parse(resp.Body)
-				if err != nil {
-					return fmt.Errorf("while parsing %s: %v", rawURL, err)
+		for _, format := range book.MissingFormats {
+			unavailable := UnavailableFormat{Book: bookURL, Format: format}
+
+			chain := opts.Fallbacks[format]
+			if opts.FallbackEpub {
+				chain = append(chain[:len(chain):len(chain)], "epub")
+			}
+			for _, fallback := range chain {
+				if fallbackURLs, ok := book.Available[fallback]; ok {
+					unavailable.Fallback = fallback
+					finalURLs.AddFormat(fallback, fallbackURLs...)
+					break
 				}
+			}
 
-				timer.Reset(connectionWait)
+			log.Printf("%s is not available in %s", bookURL, format)
+			report.Unavailable = append(report.Unavailable, unavailable)
+		}
+	}
 
-				// For each book page, get its files
-				for _, bookURL := range booksURLs {
-					err = func(bookURL *url.URL) error {
-						completeBookURL := StandardEbooksMainURL.ResolveReference(bookURL)
+	// Gets the files of an individual ebook page
+	processBook := func(bookURL string) error {
+		body, finalURL, err := fetchBook(bookURL, true)
+		if err != nil || body == nil {
+			return fail(bookURL, "fetch", err)
+		}
 
-						<-timer.C
+		book, err := ebookParser.ParseBook(bytes.NewReader(body))
+		err = softFail(bookURL, err)
+		if err != nil {
+			return fail(bookURL, "parse", fmt.Errorf("while parsing %s: %v", bookURL, err))
+		}
 
-						resp, err := client.Get(completeBookURL.String())
-						if err != nil {
-							return fmt.Errorf("while getting %s (collection: %s): %v", bookURL, rawURL, err)
-						}
-						defer resp.Body.Close()
+		addBook(bookURL, finalURL, book)
 
-						urls, err := ebookParser.Parse(resp.Body)
-						if err != nil {
-							return fmt.Errorf("while parsing %s (collection: %s): %v", bookURL, rawURL, err)
-						}
-						timer.Reset(connectionWait)
+		return nil
+	}
 
-						finalURLs.Add(urls...)
+	// Gets the files of every ebook listed in an author or collection page. kind is
+	// used to give context to errors.
+	//
+	// Up to Concurrency book pages are got at once, in order, and each one is
+	// parsed concurrently while the next ones are got. They're then added in
+	// order, so the result is the same as getting them one by one.
+	processIndex := func(rawURL string, kind string, parser IndexPageParser) error {
+		// First getting the individual books
+		resp, release, err := pacer.Get(client, rawURL)
+		if err != nil {
+			release()
+			return fail(rawURL, "fetch", fmt.Errorf("while getting %s: %v", rawURL, err))
+		}
+		defer resp.Body.Close()
 
-						return nil
-					}(bookURL)
-					if err != nil {
-						break
-					}
-				}
-				return err
-			}()
+		if resp.StatusCode != http.StatusOK {
+			release()
+			return fail(rawURL, "fetch", fmt.Errorf("while getting %s: unexpected response: %s", rawURL, resp.Status))
+		}
+
+		body, err := ReadPage(resp, opts.MaxPageSize)
+		release()
+		if err != nil {
+			return fail(rawURL, "fetch", fmt.Errorf("while getting %s: %v", rawURL, err))
+		}
+
+		booksURLs, err := parser.Parse(bytes.NewReader(body))
+		err = softFail(rawURL, err)
+		if err != nil {
+			return fail(rawURL, "parse", fmt.Errorf("while parsing %s: %v", rawURL, err))
+		}
+
+		// Safety cap on the number of books reached through author and collection
+		// pages
+		if opts.Crawl != nil {
+			err = opts.Crawl.Add(rawURL, len(booksURLs))
 			if err != nil {
-				return finalURLs, err
+				return err
 			}
+		}
 
-		} else if AuthorURLRegex.MatchString(rawURL) { // An author page
-			err = func() error {
-				// First getting the individual books
-				<-timer.C
-				resp, err := client.Get(rawURL)
-				if err != nil {
-					return fmt.Errorf("while getting %s: %v", rawURL, err)
-				}
-				defer resp.Body.Close()
+		type parsedBook struct {
+			bookURL  string
+			finalURL *url.URL
+			book     *BookPage
+			removed  bool
+			fetchErr error
+			err      error
+		}
+		parsed := make([]parsedBook, len(booksURLs))
+		concurrency := opts.Concurrency
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		fetchers := make(chan struct{}, concurrency)
+		workers := make(chan struct{}, runtime.GOMAXPROCS(0))
+		var wg sync.WaitGroup
+		// Set once a fetch fails, to stop starting new ones unless KeepGoing
+		var fetchFailed int32
+
+		// For each book page, get it and parse it in the background, once there's
+		// a free fetch slot.
+		for i, bookURL := range booksURLs {
+			fetchers <- struct{}{}
+			if !opts.KeepGoing && atomic.LoadInt32(&fetchFailed) != 0 {
+				<-fetchers
+				break
+			}
 
-				booksURLs, err := authorParser.Parse(resp.Body)
+			completeBookURL := StandardEbooksMainURL.ResolveReference(bookURL).String()
+			parsed[i].bookURL = completeBookURL
+
+			wg.Add(1)
+			go func(pb *parsedBook) {
+				defer wg.Done()
+
+				body, finalURL, err := fetchBook(pb.bookURL, false)
+				<-fetchers
 				if err != nil {
-					return fmt.Errorf("while parsing %s: %v", rawURL, err)
+					pb.fetchErr = err
+					atomic.StoreInt32(&fetchFailed, 1)
+					return
 				}
+				if body == nil {
+					pb.removed = true
+					return
+				}
+				pb.finalURL = finalURL
 
-				timer.Reset(connectionWait)
-
-				// For each book page, get its files
-				for _, bookURL := range booksURLs {
-					err = func(bookURL *url.URL) error {
-						completeBookURL := StandardEbooksMainURL.ResolveReference(bookURL)
+				workers <- struct{}{}
+				defer func() { <-workers }()
 
-						<-timer.C
-						resp, err := client.Get(completeBookURL.String())
-						if err != nil {
-							return fmt.Errorf("while getting %s (author: %s): %v", bookURL, rawURL, err)
-						}
-						defer resp.Body.Close()
+				pb.book, pb.err = ebookParser.ParseBook(bytes.NewReader(body))
+			}(&parsed[i])
+		}
+		wg.Wait()
 
-						urls, err := ebookParser.Parse(resp.Body)
-						if err != nil {
-							return fmt.Errorf("while parsing %s (author: %s): %v", bookURL, rawURL, err)
-						}
+		for _, pb := range parsed {
+			if pb.fetchErr != nil {
+				err = fail(pb.bookURL, "fetch", fmt.Errorf("%v (%s: %s)", pb.fetchErr, kind, rawURL))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if pb.removed {
+				report.Removed = append(report.Removed, pb.bookURL)
+				continue
+			}
 
-						timer.Reset(connectionWait)
+			if err := softFail(pb.bookURL, pb.err); err != nil {
+				err = fail(pb.bookURL, "parse", fmt.Errorf("while parsing %s: %v (%s: %s)", pb.bookURL, err, kind, rawURL))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			// Not got because an earlier one failed
+			if pb.book == nil {
+				continue
+			}
 
-						finalURLs.Add(urls...)
+			addBook(pb.bookURL, pb.finalURL, pb.book)
+		}
 
-						return nil
-					}(bookURL)
-					if err != nil {
-						break
-					}
-				}
+		return nil
+	}
 
-				return err
-			}()
+	for _, rawURL := range rawURLs {
+		kind, err := ClassifyURL(rawURL)
+		if err != nil {
+			err = fail(rawURL, "classify", err)
 			if err != nil {
-				return finalURLs, err
+				return finalURLs, report, err
 			}
-		} else { // Default: not a valid URL
-			return finalURLs, fmt.Errorf("%s was not recognized as a valid URL format", rawURL)
+			continue
+		}
+
+		switch kind {
+		case BookPageKind: // A single ebook
+			err = processBook(rawURL)
+		case CollectionPageKind: // A collection of ebooks
+			err = processIndex(rawURL, "collection", collectionParser)
+		case AuthorPageKind: // An author page
+			err = processIndex(rawURL, "author", authorParser)
+		}
+		if err != nil {
+			return finalURLs, report, err
 		}
 	}
 
-	return finalURLs, nil
+	return finalURLs, report, nil
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+// benchmarkFileURLs returns the URLs of the files of n books, in every format, as
+// found in their pages.
+func benchmarkFileURLs(n int) []*url.URL {
+	urls := make([]*url.URL, 0, n*len(FormatsTesters))
+	for i := 0; i < n; i++ {
+		for _, suffix := range []string{".epub", "_advanced.epub", ".kepub.epub", ".azw3"} {
+			urls = append(urls, MustParseURL(fmt.Sprintf("/ebooks/author-%d/title-%d/downloads/author-%d_title-%d%s", i, i, i, i, suffix)))
+		}
+	}
+
+	return urls
+}
+
+func BenchmarkURLSet(b *testing.B) {
+	// About the size of the whole catalog
+	urls := benchmarkFileURLs(1000)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		uset := NewURLSet(len(urls))
+		for _, u := range urls {
+			uset.AddFormat("epub", u)
+		}
+		// Every file is added twice, e. g. when found through an author page and
+		// a collection
+		for _, u := range urls {
+			uset.AddFormat("epub", u)
+		}
+
+		for _, u := range uset.ToSlice() {
+			uset.Format(u)
+		}
+	}
+}
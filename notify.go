@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Environment variables through which the title and message of a notification are
+// given to the scripts of some platforms, so they never need quoting.
+const (
+	notifyTitleEnv   = EnvPrefix + "NOTIFY_TITLE"
+	notifyMessageEnv = EnvPrefix + "NOTIFY_MESSAGE"
+)
+
+// windowsToastScript shows a toast notification through the Windows Runtime API,
+// available to PowerShell since Windows 10.
+const windowsToastScript = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $template.GetElementsByTagName('text')
+$text.Item(0).AppendChild($template.CreateTextNode($env:` + notifyTitleEnv + `)) > $null
+$text.Item(1).AppendChild($template.CreateTextNode($env:` + notifyMessageEnv + `)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('sescrp').Show([Windows.UI.Notifications.ToastNotification]::new($template))`
+
+// Notify shows a desktop notification with the native tools of each platform:
+// notify-send on Linux and the BSDs, osascript on macOS, and PowerShell on
+// Windows.
+func Notify(title, message string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("osascript", "-e", `display notification (system attribute "`+notifyMessageEnv+`") with title (system attribute "`+notifyTitleEnv+`")`)
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", windowsToastScript)
+	default:
+		cmd = exec.Command("notify-send", "--app-name=sescrp", title, message)
+	}
+	cmd.Env = append(os.Environ(), notifyTitleEnv+"="+title, notifyMessageEnv+"="+message)
+
+	combinedOutput, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("while showing a notification with %s: %v: %s", cmd.Path, err, strings.TrimSpace(string(combinedOutput)))
+	}
+
+	return nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Adaptive pacing parameters.
+const (
+	// MaxAdaptiveWait is the longest a Pacer will wait between connections, no
+	// matter how much pushback the server gives.
+	MaxAdaptiveWait = 5 * time.Minute
+	// SlowResponseThreshold is the time to get the response headers after which a
+	// server is considered to be struggling.
+	SlowResponseThreshold = 10 * time.Second
+	// MaxPushbackRetries is how many times a request is retried after a 429 or 503
+	// response.
+	MaxPushbackRetries = 3
+)
+
+// Pacer paces HTTP connections, so there's always a minimum wait between the end
+// of one connection to a host and the start of the next one to the same host.
+// Each host is paced independently, so a slow or struggling host doesn't hold back
+// connections to the others.
+//
+// If adaptive, the wait grows when a host pushes back, either with 429 or 503
+// status codes or by answering slowly, and it slowly recovers towards the
+// configured one afterwards.
+//
+// If given a RobotsCache, requests disallowed by the robots.txt of their host are
+// refused, and the wait is never shorter than the host's crawl delay.
+//
+// Every request of a run, for pages, files or robots.txt, and including retries,
+// should go through the same Pacer, which keeps count of them in its Stats. Its
+// methods can be called from several goroutines, but a connection to a host only
+// starts once the previous one to it has been released, with the release function
+// returned with its response, and its wait is over, unless connections are allowed
+// to overlap with SetOverlapping.
+type Pacer struct {
+	wait        time.Duration
+	adaptive    bool
+	robots      *RobotsCache
+	overlapping bool
+	follows     *Pacer
+
+	mu    sync.Mutex
+	hosts map[string]*hostPace
+	stats PacerStats
+}
+
+// PacerStats counts the requests made through a Pacer.
+type PacerStats struct {
+	// Requests is the number of requests made, including retries.
+	Requests int
+	// Retries is the number of requests retried after the server pushed back.
+	Retries int
+	// Hosts is the number of hosts contacted.
+	Hosts int
+	// Waited is the total time spent waiting between connections.
+	Waited time.Duration
+}
+
+// String returns the stats in a human friendly form, e. g. "412 requests to 2
+// hosts (3 retries), 7m0s spent waiting between them".
+func (stats PacerStats) String() string {
+	return fmt.Sprintf("%d requests to %d hosts (%d retries), %v spent waiting between them", stats.Requests, stats.Hosts, stats.Retries, stats.Waited.Round(time.Second))
+}
+
+// hostPace is the pacing state of a single host.
+type hostPace struct {
+	host     string
+	timer    *time.Timer
+	baseWait time.Duration
+	wait     time.Duration
+	// released is when the last turn was released, or taken if overlapping
+	released time.Time
+}
+
+// NewPacer creates a new Pacer. The first connection to each host can be made
+// immediately.
+//
+// robots can be nil to ignore robots.txt files.
+func NewPacer(wait time.Duration, adaptive bool, robots *RobotsCache) *Pacer {
+	return &Pacer{
+		wait:     wait,
+		adaptive: adaptive,
+		robots:   robots,
+		hosts:    make(map[string]*hostPace),
+	}
+}
+
+// SetOverlapping sets whether connections to the same host may overlap. If so, the
+// wait counts from the start of each connection instead of from the end of the
+// previous one, which limits the rate at which they start, shared between every
+// goroutine using the Pacer, while several of them can be open at once. Releasing
+// them does nothing then. It must be set before making any request.
+func (p *Pacer) SetOverlapping(overlapping bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.overlapping = overlapping
+}
+
+// SetFollows makes the first connection to each host wait for the last one made
+// to it through previous, e. g. a Pacer for files following the one for pages, so
+// there's a wait between both even if they are paced apart. It must be set before
+// making any request.
+func (p *Pacer) SetFollows(previous *Pacer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.follows = previous
+}
+
+// Stats returns the counts of the requests made so far.
+func (p *Pacer) Stats() PacerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Hosts = len(p.hosts)
+
+	return stats
+}
+
+// host returns the pacing state of a host, creating it if needed. p.mu must be
+// held.
+func (p *Pacer) host(host string) *hostPace {
+	hp, ok := p.hosts[host]
+	if !ok {
+		hp = &hostPace{
+			host: host,
+			// Timer initially set to expire inmediately, unless following
+			timer:    time.NewTimer(p.followingWait(host)),
+			baseWait: p.wait,
+			wait:     p.wait,
+		}
+		p.hosts[host] = hp
+	}
+
+	return hp
+}
+
+// followingWait returns what's left of the wait after the last connection to host
+// made through the Pacer followed, if any. p.mu must be held.
+func (p *Pacer) followingWait(host string) time.Duration {
+	if p.follows == nil {
+		return 0
+	}
+
+	p.follows.mu.Lock()
+	defer p.follows.mu.Unlock()
+
+	hp, ok := p.follows.hosts[host]
+	if !ok || hp.released.IsZero() {
+		return 0
+	}
+
+	wait := hp.wait - time.Since(hp.released)
+	if wait < 0 {
+		return 0
+	}
+
+	return wait
+}
+
+// Get waits for its turn and makes a GET request to rawURL with the given client.
+//
+// The release function returned must always be called after Get, once the
+// response body, if any, has been read, so the wait for the next connection to
+// the same host can start. It's never nil, even on error, so it can be deferred
+// right away.
+//
+// If the Pacer is adaptive, 429 and 503 responses are retried a few times with
+// increasing waits, honoring any Retry-After header. The last response is
+// returned as is if it never succeeds.
+func (p *Pacer) Get(client *http.Client, rawURL string) (*http.Response, func(), error) {
+	return p.GetContext(context.Background(), client, rawURL)
+}
+
+// GetContext is like Get, but the requests are made with the given context.
+func (p *Pacer) GetContext(ctx context.Context, client *http.Client, rawURL string) (*http.Response, func(), error) {
+	return p.request(ctx, client, http.MethodGet, rawURL, nil)
+}
+
+// GetWithHeader is like GetContext, but adds the given header to the requests,
+// e. g. for a Range request.
+func (p *Pacer) GetWithHeader(ctx context.Context, client *http.Client, rawURL string, header http.Header) (*http.Response, func(), error) {
+	return p.request(ctx, client, http.MethodGet, rawURL, header)
+}
+
+// Head is like Get, but makes a HEAD request.
+func (p *Pacer) Head(client *http.Client, rawURL string) (*http.Response, func(), error) {
+	return p.request(context.Background(), client, http.MethodHead, rawURL, nil)
+}
+
+// noRelease is the release function of requests that never got their turn.
+func noRelease() {}
+
+// request makes a request with the given method and extra header, which may be
+// nil, checking robots.txt first.
+func (p *Pacer) request(ctx context.Context, client *http.Client, method string, rawURL string, header http.Header) (*http.Response, func(), error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, noRelease, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	if p.robots != nil {
+		policy, err := p.robots.Policy(ctx, p, client, req.URL)
+		if err != nil {
+			return nil, noRelease, err
+		}
+
+		if !policy.Allowed(req.URL.RequestURI()) {
+			return nil, noRelease, fmt.Errorf("%s is disallowed by robots.txt", rawURL)
+		}
+
+		p.mu.Lock()
+		hp := p.host(req.URL.Host)
+		if policy.CrawlDelay > hp.baseWait {
+			hp.baseWait = policy.CrawlDelay
+		}
+		if hp.wait < hp.baseWait {
+			hp.wait = hp.baseWait
+		}
+		p.mu.Unlock()
+	}
+
+	return p.do(client, req)
+}
+
+// do makes the request once it's its turn, adapting and retrying if needed. It
+// returns the function releasing the turn taken, which is never nil.
+func (p *Pacer) do(client *http.Client, req *http.Request) (*http.Response, func(), error) {
+	p.mu.Lock()
+	hp := p.host(req.URL.Host)
+	p.mu.Unlock()
+
+	for retry := 0; ; retry++ {
+		waitStart := time.Now()
+		<-hp.timer.C
+
+		p.mu.Lock()
+		if p.overlapping {
+			hp.timer.Reset(hp.wait)
+			hp.released = time.Now()
+		}
+		release := p.releaser(hp)
+		p.stats.Requests++
+		p.stats.Waited += time.Since(waitStart)
+		if retry > 0 {
+			p.stats.Retries++
+		}
+		p.mu.Unlock()
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, release, err
+		}
+
+		if !p.adaptive {
+			return resp, release, nil
+		}
+
+		pushback := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+		p.mu.Lock()
+		hp.adapt(pushback, time.Since(start), retryAfter(resp))
+		wait := hp.wait
+		p.mu.Unlock()
+
+		if !pushback || retry >= MaxPushbackRetries {
+			return resp, release, nil
+		}
+
+		resp.Body.Close()
+		log.Printf("%s answered %s, retrying in %v", req.URL, resp.Status, wait)
+		release()
+	}
+}
+
+// releaser returns a function signaling that a connection to the host of hp has
+// ended, so the wait for the next one can start. Only the first call has any
+// effect, so a turn is never released twice. p.mu must be held.
+func (p *Pacer) releaser(hp *hostPace) func() {
+	if p.overlapping {
+		return noRelease
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+
+			hp.timer.Reset(hp.wait)
+			hp.released = time.Now()
+		})
+	}
+}
+
+// adapt adjusts the wait according to how the host responded. retryAfter is the
+// wait requested by the host, if any. The Pacer's mu must be held.
+func (hp *hostPace) adapt(pushback bool, latency, retryAfter time.Duration) {
+	previous := hp.wait
+
+	switch {
+	case pushback:
+		hp.wait *= 2
+		if hp.wait < time.Second {
+			hp.wait = time.Second
+		}
+		if hp.wait < retryAfter {
+			hp.wait = retryAfter
+		}
+	case latency > SlowResponseThreshold:
+		hp.wait += hp.wait/2 + time.Second
+	default:
+		// Recover a quarter of the way towards the configured wait
+		hp.wait -= (hp.wait - hp.baseWait) / 4
+	}
+
+	if hp.wait > MaxAdaptiveWait {
+		hp.wait = MaxAdaptiveWait
+	}
+
+	if hp.wait > previous {
+		log.Printf("server pushback detected, waiting %v between connections to %s", hp.wait, hp.host)
+	}
+}
+
+// retryAfter parses the Retry-After header of a response, in its delay-seconds or
+// HTTP-date forms. It returns 0 if it's missing or invalid.
+func retryAfter(resp *http.Response) time.Duration {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"io"
 	"net/url"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 
 	"golang.org/x/net/html"
@@ -47,9 +49,21 @@ var FormatsTesters FormatsTestersMap = map[string]TesterFunction{
 	},
 }
 
+// FormatOf returns the name of the format of the given file name or URL, according
+// to FormatsTesters, or an empty string if it doesn't match any of them.
+func FormatOf(name string) string {
+	for _, format := range FormatsTesters.GetKeys() {
+		if FormatsTesters[format](name) {
+			return format
+		}
+	}
+
+	return ""
+}
+
 // EbookPageParser parses the page of an individual ebook.
 type EbookPageParser struct {
-	extensionsTesters []TesterFunction
+	formats []string
 }
 
 // NewEbookPageParser creates a new EbookPageParser.
@@ -59,36 +73,111 @@ type EbookPageParser struct {
 // passed.
 func NewEbookPageParser(extensions string) (*EbookPageParser, error) {
 	extensionsSlice := strings.Split(extensions, ",")
-	extensionsTesters := make([]TesterFunction, 0, len(extensionsSlice))
 
 	for _, ext := range extensionsSlice {
-		fun, ok := FormatsTesters[ext]
-		if !ok {
+		if _, ok := FormatsTesters[ext]; !ok {
 			return nil, fmt.Errorf("the extension \"%s\" is not supported", ext)
 		}
-
-		extensionsTesters = append(extensionsTesters, fun)
 	}
 
 	return &EbookPageParser{
-		extensionsTesters: extensionsTesters,
+		formats: extensionsSlice,
 	}, nil
 }
 
+// BookPage is the information extracted from an individual ebook page.
+type BookPage struct {
+	// FileURLs are the URLs of the files in the active formats, relative to the
+	// StandardEbooks main url.
+	FileURLs []*url.URL
+	// WordCount is the length of the book in words, or 0 if it couldn't be found.
+	WordCount int
+	// CanonicalURL is the URL the page declares as its canonical one, or nil if
+	// it doesn't.
+	CanonicalURL *url.URL
+	// Available maps every format offered in the page, active or not, to its file
+	// URLs.
+	Available map[string][]*url.URL
+	// MissingFormats are the active formats not offered in the page.
+	MissingFormats []string
+
+	// Format of every file URL found, by its string form
+	formats map[string]string
+}
+
+// FormatOf returns the format of one of the file URLs found in the page.
+func (book *BookPage) FormatOf(fileURL *url.URL) string {
+	if format, ok := book.formats[fileURL.String()]; ok {
+		return format
+	}
+
+	return FormatOf(fileURL.Path)
+}
+
+// HrefError is a link whose href couldn't be parsed.
+type HrefError struct {
+	Href string
+	Err  error
+}
+
+// HrefErrors are the links a parser skipped because their hrefs couldn't be
+// parsed. A single bad link doesn't fail the whole page: parsers keep going and
+// return every valid URL, together with a HrefErrors as their error.
+type HrefErrors []HrefError
+
+// Error returns every skipped link, e. g. "skipped 2 unparseable links: ...".
+func (e HrefErrors) Error() string {
+	links := make([]string, 0, len(e))
+	for _, hrefErr := range e {
+		links = append(links, fmt.Sprintf("%s (%v)", hrefErr.Href, hrefErr.Err))
+	}
+
+	return fmt.Sprintf("skipped %d unparseable links: %s", len(e), strings.Join(links, ", "))
+}
+
+// orNil returns e as an error, or nil if it's empty.
+func (e HrefErrors) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// wordCountRegex finds the word count in the text of the reading ease section,
+// e. g. "95,339 words (6 hours 22 minutes) with a reading ease of...".
+var wordCountRegex = regexp.MustCompile(`([0-9][0-9,]*)\s+words`)
+
 // Parse parses a given ebook page, provided through an io.Reader.
 //
-// It returns a slice of successfully parsed *url.URLs and an error, if any. No
-// new HTTP connections are made.
+// It returns a slice of successfully parsed *url.URLs and an error, if any, which
+// is a HrefErrors if only some links were skipped. No new HTTP connections are
+// made.
 //
 // All URLs returned are relative to the StandardEbooks main url.
 func (ebookParser *EbookPageParser) Parse(htmlReader io.Reader) ([]*url.URL, error) {
+	book, err := ebookParser.ParseBook(htmlReader)
+	if book == nil {
+		return nil, err
+	}
+
+	return book.FileURLs, err
+}
+
+// ParseBook is like Parse, but also returns other information found in the page
+// besides the file URLs.
+func (ebookParser *EbookPageParser) ParseBook(htmlReader io.Reader) (*BookPage, error) {
 	doc, err := html.Parse(htmlReader)
 	if err != nil {
 		return nil, err
 	}
 
-	finalUrls := make([]*url.URL, 0, len(ebookParser.extensionsTesters))
-	err = nil
+	book := &BookPage{
+		FileURLs:  make([]*url.URL, 0, len(ebookParser.formats)),
+		Available: make(map[string][]*url.URL),
+		formats:   make(map[string]string),
+	}
+	var skipped HrefErrors
 
 	var parseF func(*html.Node)
 	parseF = func(n *html.Node) {
@@ -96,15 +185,56 @@ func (ebookParser *EbookPageParser) Parse(htmlReader io.Reader) ([]*url.URL, err
 		if n.Type == html.ElementNode && n.Data == "a" {
 			// Iterate attributes in search of an href
 			for _, attr := range n.Attr {
+				if attr.Key != "href" {
+					continue
+				}
+
+				format := linkFormat(n, attr.Val)
+				if format == "" {
+					continue
+				}
+
+				newURL, localError := url.Parse(attr.Val)
+				if localError != nil {
+					skipped = append(skipped, HrefError{Href: attr.Val, Err: localError})
+					continue
+				}
+
+				book.Available[format] = append(book.Available[format], newURL)
+				book.formats[newURL.String()] = format
+
 				// Add url if it matches one of the active formats
-				if attr.Key == "href" && ebookParser.urlMatches(attr.Val) {
-					newURL, localError := url.Parse(attr.Val)
-					if localError != nil {
-						err = fmt.Errorf("while processing %s: %v", attr.Val, localError)
-						return
-					}
+				if ebookParser.formatActive(format) {
+					book.FileURLs = append(book.FileURLs, newURL)
+				}
+			}
+		}
 
-					finalUrls = append(finalUrls, newURL)
+		// Detect the canonical URL
+		if n.Type == html.ElementNode && n.Data == "link" && book.CanonicalURL == nil {
+			var rel, href string
+			for _, attr := range n.Attr {
+				switch attr.Key {
+				case "rel":
+					rel = attr.Val
+				case "href":
+					href = attr.Val
+				}
+			}
+
+			if rel == "canonical" && href != "" {
+				canonicalURL, localError := url.Parse(href)
+				if localError == nil {
+					book.CanonicalURL = canonicalURL
+				}
+			}
+		}
+
+		// Detect the word count, either marked up as such or in the reading ease section
+		if n.Type == html.ElementNode && book.WordCount == 0 {
+			for _, attr := range n.Attr {
+				if (attr.Key == "property" && attr.Val == "schema:wordCount") || (attr.Key == "id" && attr.Val == "reading-ease") {
+					book.WordCount = parseWordCount(textContent(n))
 				}
 			}
 		}
@@ -118,13 +248,50 @@ func (ebookParser *EbookPageParser) Parse(htmlReader io.Reader) ([]*url.URL, err
 	// Start the search
 	parseF(doc)
 
-	return finalUrls, err
+	for _, format := range ebookParser.formats {
+		if _, ok := book.Available[format]; !ok {
+			book.MissingFormats = append(book.MissingFormats, format)
+		}
+	}
+
+	return book, skipped.orNil()
 }
 
-// Check if the given URL (in string form) matches any of the active extensions.
-func (ebookParser *EbookPageParser) urlMatches(url string) bool {
-	for _, test := range ebookParser.extensionsTesters {
-		if test(url) {
+// parseWordCount extracts a word count like "95,339" or "95,339 words" from a text.
+// It returns 0 if there's none.
+func parseWordCount(text string) int {
+	text = strings.TrimSpace(text)
+	if match := wordCountRegex.FindStringSubmatch(text); match != nil {
+		text = match[1]
+	}
+
+	count, err := strconv.Atoi(strings.ReplaceAll(text, ",", ""))
+	if err != nil {
+		return 0
+	}
+
+	return count
+}
+
+// textContent returns all the text inside a node, like the DOM property of the
+// same name.
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(textContent(c))
+	}
+
+	return sb.String()
+}
+
+// Check if the given format is one of the active ones.
+func (ebookParser *EbookPageParser) formatActive(format string) bool {
+	for _, active := range ebookParser.formats {
+		if format == active {
 			return true
 		}
 	}
@@ -132,8 +299,45 @@ func (ebookParser *EbookPageParser) urlMatches(url string) bool {
 	return false
 }
 
+// linkFormat returns the format of the file a download link points to.
+//
+// Epub links are told apart by their label or class, e. g. "Advanced epub" or
+// "Compatible epub", so the advanced edition is recognized even if the naming
+// convention of its file changes. Otherwise, and for other formats, the format is
+// deduced from the file name in href.
+func linkFormat(link *html.Node, href string) string {
+	format := FormatOf(href)
+	if !strings.HasSuffix(href, ".epub") || format == "kepub" {
+		return format
+	}
+
+	label := strings.ToLower(textContent(link))
+	for _, attr := range link.Attr {
+		if attr.Key == "class" {
+			label += " " + strings.ToLower(attr.Val)
+		}
+	}
+
+	switch {
+	case strings.Contains(label, "advanced"):
+		return "aepub"
+	case strings.Contains(label, "epub"):
+		return "epub"
+	default:
+		return format
+	}
+}
+
+// IndexPageParser parses a page that lists several books, returning the URLs of
+// the individual book pages.
+type IndexPageParser interface {
+	Parse(htmlReader io.Reader) ([]*url.URL, error)
+}
+
 // CollectionPageParser parses the page of an entire collection
 type CollectionPageParser struct {
+	// Layout, if not nil, is used instead of the one detected in the page.
+	Layout *IndexLayout
 }
 
 // NewCollectionPageParser creates a new CollectionPageParser
@@ -143,8 +347,8 @@ func NewCollectionPageParser() *CollectionPageParser {
 
 // Parse parses a given collection page, provided through an io.Reader.
 //
-// It returns a slice with the *url.URLs of all individual book pages. No HTTP
-// connection is actually made.
+// It returns a slice with the *url.URLs of all individual book pages, and a
+// HrefErrors if some links were skipped. No HTTP connection is actually made.
 //
 // All URLs returned are relative to the StandardEbooks main url.
 func (collectionParser *CollectionPageParser) Parse(htmlReader io.Reader) ([]*url.URL, error) {
@@ -153,25 +357,31 @@ func (collectionParser *CollectionPageParser) Parse(htmlReader io.Reader) ([]*ur
 		return nil, err
 	}
 
+	layout := collectionParser.Layout
+	if layout == nil {
+		layout = DetectIndexLayout(doc)
+	}
+
 	finalUrls := make([]*url.URL, 0)
-	err = nil
+	seen := make(map[string]struct{})
+	var skipped HrefErrors
 
 	var parseF func(n *html.Node)
 	parseF = func(n *html.Node) {
-		// Detect links
-		if n.Type == html.ElementNode && n.Data == "a" {
-			// This link must be inside a <p> with no attributes, which is inside a <li>
-			if n.Parent.Type == html.ElementNode && n.Parent.Data == "p" && len(n.Parent.Attr) == 0 && n.Parent.Parent.Type == html.ElementNode && n.Parent.Parent.Data == "li" {
-				for _, attr := range n.Attr {
-					if attr.Key == "href" {
-						newURL, localErr := url.Parse(attr.Val)
-						if localErr != nil {
-							err = fmt.Errorf("while processing %s: %v", attr.Val, localErr)
-							return
-						}
-
-						finalUrls = append(finalUrls, newURL)
+		// Detect links, which may appear more than once per book, e. g. in the
+		// cover and the title
+		if n.Type == html.ElementNode && n.Data == "a" && layout.BookLink(n) {
+			for _, attr := range n.Attr {
+				if _, ok := seen[attr.Val]; attr.Key == "href" && !ok {
+					newURL, localErr := url.Parse(attr.Val)
+					if localErr != nil {
+						skipped = append(skipped, HrefError{Href: attr.Val, Err: localErr})
+						seen[attr.Val] = struct{}{}
+						continue
 					}
+
+					finalUrls = append(finalUrls, newURL)
+					seen[attr.Val] = struct{}{}
 				}
 			}
 		}
@@ -184,11 +394,13 @@ func (collectionParser *CollectionPageParser) Parse(htmlReader io.Reader) ([]*ur
 
 	parseF(doc)
 
-	return finalUrls, err
+	return finalUrls, skipped.orNil()
 }
 
 // AuthorPageParser parses the page of an author.
 type AuthorPageParser struct {
+	// Layout, if not nil, is used instead of the one detected in the page.
+	Layout *IndexLayout
 }
 
 // NewAuthorPageParser creates a new AuthorPageParser
@@ -198,8 +410,8 @@ func NewAuthorPageParser() *AuthorPageParser {
 
 // Parse parses a given author page, provided through an io.Reader.
 //
-// It returns a slice with the *url.URLs of all individual book pages. No HTTP
-// connection is actually made.
+// It returns a slice with the *url.URLs of all individual book pages, and a
+// HrefErrors if some links were skipped. No HTTP connection is actually made.
 //
 // All URLs returned are relative to the StandardEbooks main url.
 func (authorParser *AuthorPageParser) Parse(htmlReader io.Reader) ([]*url.URL, error) {
@@ -208,27 +420,32 @@ func (authorParser *AuthorPageParser) Parse(htmlReader io.Reader) ([]*url.URL, e
 		return nil, err
 	}
 
+	// As of right now, the layouts are the same as for collections, but this is
+	// implemented on its own, in case this canges in the future.
+	layout := authorParser.Layout
+	if layout == nil {
+		layout = DetectIndexLayout(doc)
+	}
+
 	finalUrls := make([]*url.URL, 0)
-	err = nil
+	seen := make(map[string]struct{})
+	var skipped HrefErrors
 
 	var parseF func(n *html.Node)
 	parseF = func(n *html.Node) {
-		// Detect links
-		if n.Type == html.ElementNode && n.Data == "a" {
-			// This link must be inside a <p> with no attributes, which is inside a <li>.
-			// As of right now, this seems to be the same rule as for collections,
-			// but it's implemented on its own, in case this canges in the future.
-			if n.Parent.Type == html.ElementNode && n.Parent.Data == "p" && len(n.Parent.Attr) == 0 && n.Parent.Parent.Type == html.ElementNode && n.Parent.Parent.Data == "li" {
-				for _, attr := range n.Attr {
-					if attr.Key == "href" {
-						newURL, localErr := url.Parse(attr.Val)
-						if localErr != nil {
-							err = fmt.Errorf("while processing %s: %v", attr.Val, localErr)
-							return
-						}
-
-						finalUrls = append(finalUrls, newURL)
+		// Detect links, which may appear more than once per book
+		if n.Type == html.ElementNode && n.Data == "a" && layout.BookLink(n) {
+			for _, attr := range n.Attr {
+				if _, ok := seen[attr.Val]; attr.Key == "href" && !ok {
+					newURL, localErr := url.Parse(attr.Val)
+					if localErr != nil {
+						skipped = append(skipped, HrefError{Href: attr.Val, Err: localErr})
+						seen[attr.Val] = struct{}{}
+						continue
 					}
+
+					finalUrls = append(finalUrls, newURL)
+					seen[attr.Val] = struct{}{}
 				}
 			}
 		}
@@ -241,5 +458,5 @@ func (authorParser *AuthorPageParser) Parse(htmlReader io.Reader) ([]*url.URL, e
 
 	parseF(doc)
 
-	return finalUrls, err
+	return finalUrls, skipped.orNil()
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// MaxFilenameLength is the longest file name, in bytes, accepted by most
+// filesystems.
+const MaxFilenameLength = 255
+
+// CheckWritableDir checks that a file can be created in dir.
+func CheckWritableDir(dir string) error {
+	f, err := ioutil.TempFile(dir, ".sescrp-check-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", dir, err)
+	}
+
+	f.Close()
+	os.Remove(f.Name())
+
+	return nil
+}
+
+// CheckWritableDirs checks every directory with CheckWritableDir, returning all
+// the problems found, in the order of dirs.
+func CheckWritableDirs(dirs []string) []error {
+	problems := make([]error, 0)
+	for _, dir := range RemoveStringDuplicates(dirs) {
+		err := CheckWritableDir(dir)
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	return problems
+}
+
+// CheckFilenames checks the absolute filenames where the given queued files will
+// be saved, as returned by filename, for names too long for most filesystems and
+// for several files that would be saved with the same name. It returns all the
+// problems found.
+func CheckFilenames(queue []QueueItem, filename func(QueueItem) string) []error {
+	problems := make([]error, 0)
+	sources := make(map[string][]string, len(queue))
+	order := make([]string, 0, len(queue))
+
+	for _, item := range queue {
+		absFilename := filename(item)
+		if len(filepath.Base(absFilename)) > MaxFilenameLength {
+			problems = append(problems, fmt.Errorf("%s: file name longer than %d bytes", absFilename, MaxFilenameLength))
+		}
+
+		if _, ok := sources[absFilename]; !ok {
+			order = append(order, absFilename)
+		}
+		sources[absFilename] = append(sources[absFilename], item.URL.String())
+	}
+
+	for _, absFilename := range order {
+		if urls := sources[absFilename]; len(urls) > 1 {
+			sort.Strings(urls)
+			problems = append(problems, fmt.Errorf("%s: would be written by %d files: %v; check -rename and the directory options", absFilename, len(urls), urls))
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+)
+
+// Preset is a bundle of flag values suited for a kind of reading device.
+type Preset struct {
+	// Formats is the value for the -formats flag.
+	Formats string
+	// TrimKepub is the value for the -trim-kepub flag.
+	TrimKepub bool
+}
+
+// Presets maps a preset name to its flag values.
+var Presets = map[string]Preset{
+	"kobo": {
+		Formats:   "kepub",
+		TrimKepub: true,
+	},
+	"kindle": {
+		Formats: "azw3",
+	},
+	"generic": {
+		Formats: "epub",
+	},
+}
+
+// PresetNames returns the sorted names of all presets.
+func PresetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for name := range Presets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// ApplyPreset sets the flags bundled in the named preset, except for those
+// explicitly given in the command line, which always take priority. It must be
+// called after flag.Parse.
+func ApplyPreset(name string) error {
+	preset, ok := Presets[name]
+	if !ok {
+		return fmt.Errorf("the preset \"%s\" is not supported", name)
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if !explicit["formats"] {
+		*extensions = preset.Formats
+	}
+	if !explicit["trim-kepub"] {
+		*trimKepub = preset.TrimKepub
+	}
+
+	return nil
+}
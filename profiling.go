@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	_ "net/http/pprof" // Registers the /debug/pprof handlers
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// Profiler manages the runtime profiling requested by the user.
+type Profiler struct {
+	cpuFile  *os.File
+	heapPath string
+}
+
+// StartProfiling starts the requested kinds of profiling. Any empty argument
+// disables that kind.
+//
+// pprofAddr is an address where the net/http/pprof handlers will be served, e. g.
+// ":6060". cpuPath and heapPath are files where the CPU and heap profiles will be
+// written; the former starts being recorded right away, while the latter is only
+// taken when calling Stop.
+func StartProfiling(pprofAddr, cpuPath, heapPath string) (*Profiler, error) {
+	prof := &Profiler{
+		heapPath: heapPath,
+	}
+
+	if pprofAddr != "" {
+		go func() {
+			log.Printf("serving pprof on %s", pprofAddr)
+			err := http.ListenAndServe(pprofAddr, nil)
+			if err != nil {
+				log.Printf("pprof server stopped: %v", err)
+			}
+		}()
+	}
+
+	if cpuPath != "" {
+		f, err := os.Create(cpuPath)
+		if err != nil {
+			return nil, fmt.Errorf("while creating CPU profile: %v", err)
+		}
+
+		err = pprof.StartCPUProfile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("while starting CPU profile: %v", err)
+		}
+
+		prof.cpuFile = f
+	}
+
+	return prof, nil
+}
+
+// Stop finishes the CPU profile, if any, and writes the heap profile, if requested.
+func (prof *Profiler) Stop() error {
+	if prof.cpuFile != nil {
+		pprof.StopCPUProfile()
+		err := prof.cpuFile.Close()
+		if err != nil {
+			return fmt.Errorf("while closing CPU profile: %v", err)
+		}
+	}
+
+	if prof.heapPath != "" {
+		f, err := os.Create(prof.heapPath)
+		if err != nil {
+			return fmt.Errorf("while creating heap profile: %v", err)
+		}
+		defer f.Close()
+
+		// Get up-to-date statistics
+		runtime.GC()
+
+		err = pprof.WriteHeapProfile(f)
+		if err != nil {
+			return fmt.Errorf("while writing heap profile: %v", err)
+		}
+	}
+
+	return nil
+}
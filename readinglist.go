@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ReadingListEntry is a book in a reading list exported from another service.
+type ReadingListEntry struct {
+	Title  string
+	Author string
+}
+
+// Query returns a search query that should find the entry in Standard Ebooks.
+func (entry ReadingListEntry) Query() string {
+	return strings.TrimSpace(entry.Title + " " + entry.Author)
+}
+
+// seriesSuffixRegex matches the series information Goodreads appends to titles,
+// e. g. " (Sherlock Holmes, #3)".
+var seriesSuffixRegex = regexp.MustCompile(`\s*\([^()]*#[^()]*\)\s*$`)
+
+// Column names in the CSV exports of supported services, in order of preference.
+var (
+	readingListTitleColumns  = []string{"title"}
+	readingListAuthorColumns = []string{"author", "authors"}
+	// Goodreads and StoryGraph, respectively
+	readingListShelfColumns = []string{"exclusive shelf", "read status"}
+)
+
+// ReadReadingList reads the books in a CSV export from Goodreads or StoryGraph.
+//
+// If shelf is not empty, only books in that shelf (e. g., "to-read") are
+// returned.
+func ReadReadingList(filename string, shelf string) ([]ReadingListEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header of %s: %v", filename, err)
+	}
+
+	titleCol := findColumn(header, readingListTitleColumns)
+	authorCol := findColumn(header, readingListAuthorColumns)
+	shelfCol := findColumn(header, readingListShelfColumns)
+	if titleCol < 0 {
+		return nil, fmt.Errorf("%s has no title column; is it a Goodreads or StoryGraph export?", filename)
+	}
+	if shelf != "" && shelfCol < 0 {
+		return nil, fmt.Errorf("%s has no shelf column to filter by", filename)
+	}
+
+	entries := make([]ReadingListEntry, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("while reading %s: %v", filename, err)
+		}
+
+		if shelf != "" && (shelfCol >= len(record) || !strings.EqualFold(strings.TrimSpace(record[shelfCol]), shelf)) {
+			continue
+		}
+
+		entry := ReadingListEntry{}
+		if titleCol < len(record) {
+			entry.Title = seriesSuffixRegex.ReplaceAllString(strings.TrimSpace(record[titleCol]), "")
+		}
+		if authorCol >= 0 && authorCol < len(record) {
+			// StoryGraph lists all authors separated by commas; the first is enough
+			entry.Author = strings.TrimSpace(strings.Split(record[authorCol], ",")[0])
+		}
+
+		if entry.Title != "" {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// findColumn returns the index of the first of the given names found in the
+// header, compared case-insensitively, or -1 if there's none.
+func findColumn(header []string, names []string) int {
+	for _, name := range names {
+		for i, column := range header {
+			if strings.EqualFold(strings.TrimSpace(column), name) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RenameRule renames the files whose name matches Pattern, replacing the matches
+// with Replacement, which can refer to submatches as in regexp.Expand, e. g. "$1".
+type RenameRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// TrimKepubRule is the rule applied by -trim-kepub, saving kepub files with the
+// extension ".kepub" instead of ".kepub.epub".
+var TrimKepubRule = RenameRule{
+	Pattern:     regexp.MustCompile(`\.kepub\.epub$`),
+	Replacement: ".kepub",
+}
+
+// ParseRenameRule parses a rule in the form "pattern=replacement", where pattern
+// is a regular expression. The replacement can be empty, to remove the matches.
+func ParseRenameRule(rule string) (RenameRule, error) {
+	parts := strings.SplitN(rule, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return RenameRule{}, fmt.Errorf("expected pattern=replacement, got \"%s\"", rule)
+	}
+
+	pattern, err := regexp.Compile(parts[0])
+	if err != nil {
+		return RenameRule{}, fmt.Errorf("invalid pattern \"%s\": %v", parts[0], err)
+	}
+
+	return RenameRule{
+		Pattern:     pattern,
+		Replacement: parts[1],
+	}, nil
+}
+
+// Apply returns filename renamed by the rule.
+func (rule RenameRule) Apply(filename string) string {
+	return rule.Pattern.ReplaceAllString(filename, rule.Replacement)
+}
+
+// ApplyRenameRules applies every rule to filename, in order, each one to the
+// result of the previous.
+func ApplyRenameRules(rules []RenameRule, filename string) string {
+	for _, rule := range rules {
+		filename = rule.Apply(filename)
+	}
+
+	return filename
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RobotsUserAgent is the product token looked for in robots.txt groups.
+const RobotsUserAgent = "sescrp"
+
+// robotsRule is a single Allow or Disallow line of a robots.txt group.
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// RobotsPolicy is the set of robots.txt rules that apply to sescrp on a host.
+type RobotsPolicy struct {
+	rules []robotsRule
+
+	// CrawlDelay is the wait between connections requested by the host, if any.
+	CrawlDelay time.Duration
+}
+
+// ParseRobots parses a robots.txt file, keeping only the rules of the group for
+// the given user agent or, if there's none, the ones for "*". User agents are
+// matched by their product token, ignoring case.
+func ParseRobots(r io.Reader, userAgent string) (*RobotsPolicy, error) {
+	userAgent = strings.ToLower(userAgent)
+
+	var specific, wildcard *RobotsPolicy
+	// Policies the lines being read apply to; a group can name several agents
+	current := make([]*RobotsPolicy, 0)
+	readingAgents := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+
+		if key == "user-agent" {
+			if !readingAgents {
+				current = current[:0]
+				readingAgents = true
+			}
+
+			// Only the product token is compared, without any version, e. g. the
+			// "sescrp" of "sescrp/1.0"
+			agent := strings.ToLower(value)
+			if i := strings.IndexAny(agent, "/ \t"); i >= 0 {
+				agent = agent[:i]
+			}
+
+			switch {
+			case agent == "*":
+				if wildcard == nil {
+					wildcard = &RobotsPolicy{}
+				}
+				current = append(current, wildcard)
+			case agent == userAgent:
+				if specific == nil {
+					specific = &RobotsPolicy{}
+				}
+				current = append(current, specific)
+			}
+
+			continue
+		}
+		readingAgents = false
+
+		for _, policy := range current {
+			switch key {
+			case "allow", "disallow":
+				// An empty Disallow means everything is allowed
+				if value != "" {
+					policy.rules = append(policy.rules, robotsRule{allow: key == "allow", pattern: value})
+				}
+			case "crawl-delay":
+				seconds, err := strconv.ParseFloat(value, 64)
+				if err == nil && seconds > 0 {
+					policy.CrawlDelay = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case specific != nil:
+		return specific, nil
+	case wildcard != nil:
+		return wildcard, nil
+	default:
+		return &RobotsPolicy{}, nil
+	}
+}
+
+// Allowed reports whether the given URL path (with its query, if any) may be
+// fetched. The most specific matching rule wins, and Allow wins ties.
+func (rp *RobotsPolicy) Allowed(path string) bool {
+	allowed := true
+	longest := -1
+
+	for _, rule := range rp.rules {
+		if robotsMatch(rule.pattern, path) && (len(rule.pattern) > longest || len(rule.pattern) == longest && rule.allow) {
+			allowed = rule.allow
+			longest = len(rule.pattern)
+		}
+	}
+
+	return allowed
+}
+
+// robotsMatch reports whether a path matches a robots.txt pattern, which is a
+// prefix that may contain "*" wildcards and end with "$" to anchor it.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+
+	pieces := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, pieces[0]) {
+		return false
+	}
+	rest := path[len(pieces[0]):]
+
+	for i, piece := range pieces[1:] {
+		// The last piece of an anchored pattern must be at the very end
+		if anchored && i == len(pieces)-2 {
+			return strings.HasSuffix(rest, piece)
+		}
+
+		j := strings.Index(rest, piece)
+		if j < 0 {
+			return false
+		}
+		rest = rest[j+len(piece):]
+	}
+
+	return !anchored || rest == ""
+}
+
+// RobotsCache fetches and keeps the robots.txt policies of every host contacted.
+type RobotsCache struct {
+	mu       sync.Mutex
+	policies map[string]*RobotsPolicy
+	// fetching has a channel for every host whose robots.txt is being fetched,
+	// closed once done
+	fetching map[string]chan struct{}
+}
+
+// NewRobotsCache creates a new, empty RobotsCache.
+func NewRobotsCache() *RobotsCache {
+	return &RobotsCache{
+		policies: make(map[string]*RobotsPolicy),
+		fetching: make(map[string]chan struct{}),
+	}
+}
+
+// Policy returns the policy for the host of u, fetching its robots.txt through the
+// pacer the first time. Requests to other hosts don't wait for the fetch, while
+// the ones to the same host wait for its result.
+//
+// A missing robots.txt (any 4xx status) allows everything. Any other error is
+// returned, and the fetch will be tried again the next time.
+func (rc *RobotsCache) Policy(ctx context.Context, pacer *Pacer, client *http.Client, u *url.URL) (*RobotsPolicy, error) {
+	host := u.Scheme + "://" + u.Host
+
+	for {
+		rc.mu.Lock()
+		if policy, ok := rc.policies[host]; ok {
+			rc.mu.Unlock()
+			return policy, nil
+		}
+
+		done, ok := rc.fetching[host]
+		if !ok {
+			break
+		}
+		rc.mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	done := make(chan struct{})
+	rc.fetching[host] = done
+	rc.mu.Unlock()
+
+	policy, err := rc.fetch(ctx, pacer, client, host)
+
+	rc.mu.Lock()
+	if err == nil {
+		rc.policies[host] = policy
+	}
+	delete(rc.fetching, host)
+	close(done)
+	rc.mu.Unlock()
+
+	return policy, err
+}
+
+// fetch gets and parses the robots.txt of host, given as scheme and host.
+func (rc *RobotsCache) fetch(ctx context.Context, pacer *Pacer, client *http.Client, host string) (*RobotsPolicy, error) {
+	robotsURL := host + "/robots.txt"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, release, err := pacer.do(client, req)
+	defer release()
+	if err != nil {
+		return nil, fmt.Errorf("while getting %s: %v", robotsURL, err)
+	}
+	defer resp.Body.Close()
+
+	var policy *RobotsPolicy
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		policy, err = ParseRobots(resp.Body, RobotsUserAgent)
+		if err != nil {
+			return nil, fmt.Errorf("while parsing %s: %v", robotsURL, err)
+		}
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		policy = &RobotsPolicy{}
+	default:
+		return nil, fmt.Errorf("while getting %s: unexpected response: %s", robotsURL, resp.Status)
+	}
+
+	if policy.CrawlDelay > 0 {
+		log.Printf("%s asks for a crawl delay of %v", host, policy.CrawlDelay)
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRobotsMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/", "/ebooks", true},
+		{"/ebooks", "/ebooks/jane-austen", true},
+		{"/ebooks", "/collections", false},
+		{"/ebooks/*/downloads", "/ebooks/jane-austen/emma/downloads/jane-austen_emma.epub", true},
+		{"/ebooks/*/downloads", "/ebooks/jane-austen/emma", false},
+		{"/*.epub", "/ebooks/jane-austen/emma/downloads/jane-austen_emma.epub", true},
+		{"/*.epub$", "/ebooks/jane-austen/emma/downloads/jane-austen_emma.epub", true},
+		{"/*.epub$", "/ebooks/jane-austen/emma/downloads/jane-austen_emma.epub?source=download", false},
+		{"/*.epub$", "/ebooks/jane-austen/emma/downloads/jane-austen_emma.kepub.epub", true},
+		{"/ebooks$", "/ebooks", true},
+		{"/ebooks$", "/ebooks/", false},
+		{"/*?*", "/ebooks?page=2", true},
+		{"/*?*", "/ebooks", false},
+		{"*", "/anything", true},
+	}
+
+	for _, test := range tests {
+		if got := robotsMatch(test.pattern, test.path); got != test.want {
+			t.Errorf("robotsMatch(%q, %q) = %v; want %v", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestParseRobots(t *testing.T) {
+	tests := []struct {
+		name       string
+		robots     string
+		allowed    []string
+		disallowed []string
+		crawlDelay time.Duration
+	}{
+		{
+			name:    "empty",
+			robots:  "",
+			allowed: []string{"/", "/ebooks/jane-austen/emma"},
+		},
+		{
+			name:       "wildcard group",
+			robots:     "User-agent: *\nDisallow: /ebooks\nCrawl-delay: 2\n",
+			allowed:    []string{"/", "/collections/the-modern-library"},
+			disallowed: []string{"/ebooks/jane-austen/emma"},
+			crawlDelay: 2 * time.Second,
+		},
+		{
+			name:       "specific group over wildcard",
+			robots:     "User-agent: *\nDisallow: /\n\nUser-agent: Sescrp/1.0\nDisallow: /search\n",
+			allowed:    []string{"/ebooks/jane-austen/emma"},
+			disallowed: []string{"/search?query=austen"},
+		},
+		{
+			name:       "other agents ignored",
+			robots:     "User-agent: sescrpbot\nDisallow: /\n",
+			allowed:    []string{"/ebooks"},
+			disallowed: nil,
+		},
+		{
+			name:       "groups naming several agents",
+			robots:     "User-agent: otherbot\nUser-agent: sescrp\nDisallow: /feeds\n\nUser-agent: otherbot\nDisallow: /ebooks\n",
+			allowed:    []string{"/ebooks/jane-austen/emma"},
+			disallowed: []string{"/feeds/opds"},
+		},
+		{
+			name:       "groups for the same agent merged",
+			robots:     "User-agent: sescrp\nDisallow: /feeds\n\nUser-agent: *\nDisallow: /\n\nUser-agent: sescrp\nDisallow: /search\nCrawl-delay: 0.5\n",
+			allowed:    []string{"/ebooks/jane-austen/emma"},
+			disallowed: []string{"/feeds/opds", "/search"},
+			crawlDelay: 500 * time.Millisecond,
+		},
+		{
+			name:       "longest match wins",
+			robots:     "User-agent: *\nDisallow: /ebooks\nAllow: /ebooks/*/downloads\n",
+			allowed:    []string{"/ebooks/jane-austen/emma/downloads/jane-austen_emma.epub"},
+			disallowed: []string{"/ebooks/jane-austen/emma"},
+		},
+		{
+			name:       "allow wins ties",
+			robots:     "User-agent: *\nDisallow: /ebooks\nAllow: /ebooks\nDisallow: /feeds\nAllow: /feed*\n",
+			allowed:    []string{"/ebooks/jane-austen/emma", "/feeds/opds"},
+			disallowed: nil,
+		},
+		{
+			name:       "anchored patterns",
+			robots:     "User-agent: *\nDisallow: /*.azw3$\n",
+			allowed:    []string{"/ebooks/jane-austen/emma/downloads/jane-austen_emma.azw3?source=download"},
+			disallowed: []string{"/ebooks/jane-austen/emma/downloads/jane-austen_emma.azw3"},
+		},
+		{
+			name:    "empty disallow and comments",
+			robots:  "# Everything is fine\nUser-agent: * # everyone\nDisallow:\n",
+			allowed: []string{"/", "/ebooks"},
+		},
+	}
+
+	for _, test := range tests {
+		policy, err := ParseRobots(strings.NewReader(test.robots), RobotsUserAgent)
+		if err != nil {
+			t.Errorf("%s: ParseRobots: %v", test.name, err)
+			continue
+		}
+
+		for _, path := range test.allowed {
+			if !policy.Allowed(path) {
+				t.Errorf("%s: %q disallowed; want allowed", test.name, path)
+			}
+		}
+		for _, path := range test.disallowed {
+			if policy.Allowed(path) {
+				t.Errorf("%s: %q allowed; want disallowed", test.name, path)
+			}
+		}
+		if policy.CrawlDelay != test.crawlDelay {
+			t.Errorf("%s: crawl delay %v; want %v", test.name, policy.CrawlDelay, test.crawlDelay)
+		}
+	}
+}
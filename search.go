@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// MaxSearchCandidates is the maximum number of search results offered to choose
+// from.
+const MaxSearchCandidates = 10
+
+// SearchURL returns the URL of the Standard Ebooks search results for a query.
+func SearchURL(query string) string {
+	searchURL := *StandardEbooksMainURL
+	searchURL.Path = "/ebooks"
+	searchURL.RawQuery = url.Values{"query": {query}}.Encode()
+
+	return searchURL.String()
+}
+
+// Search searches Standard Ebooks, returning the URLs of the matching book pages
+// in the order given by the site, best matches first.
+//
+// The pacer will be used to peace the HTTP connection, as with NormalizeURLs.
+// Results pages over maxPageSize bytes are refused, as with ReadPage.
+//
+// All URLs returned are relative to the StandardEbooks main url.
+func Search(query string, maxPageSize int64, pacer *Pacer, client *http.Client) ([]*url.URL, error) {
+	searchURL := SearchURL(query)
+
+	resp, release, err := pacer.Get(client, searchURL)
+	defer release()
+	if err != nil {
+		return nil, fmt.Errorf("while getting %s: %v", searchURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("while getting %s: unexpected response: %s", searchURL, resp.Status)
+	}
+
+	body, err := ReadPage(resp, maxPageSize)
+	if err != nil {
+		return nil, fmt.Errorf("while getting %s: %v", searchURL, err)
+	}
+
+	// Search results are listed just like the books of a collection
+	booksURLs, err := NewCollectionPageParser().Parse(bytes.NewReader(body))
+	if skipped, ok := err.(HrefErrors); ok {
+		log.Printf("warning: %s: %v", searchURL, skipped)
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("while parsing %s: %v", searchURL, err)
+	}
+
+	return booksURLs, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Known pages used by RunSelfCheck. The book should be offered in every format,
+// and be listed in its author's page and in at least one collection.
+var (
+	SelfCheckBookURL   = "https://standardebooks.org/ebooks/jane-austen/pride-and-prejudice"
+	SelfCheckAuthorURL = "https://standardebooks.org/ebooks/jane-austen"
+)
+
+// RunSelfCheck gets a known book, its author page and one of its collections, and
+// checks that the parsers still find what they should in them. A failure most
+// likely means Standard Ebooks changed its HTML, and sescrp needs to be updated.
+//
+// Pages over maxPageSize bytes are refused, as with ReadPage.
+func RunSelfCheck(maxPageSize int64, pacer *Pacer, client *http.Client) []Finding {
+	findings := make([]Finding, 0, 3)
+
+	// Book page
+	finding := Finding{Check: "book page " + SelfCheckBookURL}
+	body, err := selfCheckGet(maxPageSize, pacer, client, SelfCheckBookURL)
+	var collectionURL *url.URL
+	if err == nil {
+		finding.Result, err = checkBookPage(body)
+	}
+	if err == nil {
+		collectionURL, err = findCollectionLink(bytes.NewReader(body))
+	}
+	finding.Err = err
+	findings = append(findings, finding)
+
+	// Author page
+	finding = Finding{Check: "author page " + SelfCheckAuthorURL}
+	body, err = selfCheckGet(maxPageSize, pacer, client, SelfCheckAuthorURL)
+	if err == nil {
+		finding.Result, err = checkIndexPage(body, NewAuthorPageParser())
+	}
+	finding.Err = err
+	findings = append(findings, finding)
+
+	// Collection page, found in the book page
+	if collectionURL != nil {
+		rawURL := StandardEbooksMainURL.ResolveReference(collectionURL).String()
+		finding = Finding{Check: "collection page " + rawURL}
+		body, err = selfCheckGet(maxPageSize, pacer, client, rawURL)
+		if err == nil {
+			finding.Result, err = checkIndexPage(body, NewCollectionPageParser())
+		}
+		finding.Err = err
+		findings = append(findings, finding)
+	}
+
+	return findings
+}
+
+// selfCheckGet gets the body of a page.
+func selfCheckGet(maxPageSize int64, pacer *Pacer, client *http.Client, rawURL string) ([]byte, error) {
+	resp, release, err := pacer.Get(client, rawURL)
+	defer release()
+	if err != nil {
+		return nil, fmt.Errorf("%v; try -doctor to check your connection", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response: %s; the page may have moved", resp.Status)
+	}
+
+	return ReadPage(resp, maxPageSize)
+}
+
+// checkBookPage checks that every format and the word count are found in a book
+// page.
+func checkBookPage(body []byte) (string, error) {
+	parser, err := NewEbookPageParser(strings.Join(FormatsTesters.GetKeys(), ","))
+	if err != nil {
+		return "", err
+	}
+
+	book, err := parser.ParseBook(bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("unparseable: %v", err)
+	}
+
+	if len(book.MissingFormats) > 0 {
+		return "", fmt.Errorf("no download links found for %s; the page layout may have changed", strings.Join(book.MissingFormats, ", "))
+	}
+	if book.WordCount == 0 {
+		return "", fmt.Errorf("no word count found; the page layout may have changed")
+	}
+
+	return fmt.Sprintf("%d files, %d words", len(book.FileURLs), book.WordCount), nil
+}
+
+// checkIndexPage checks that an author or collection page lists some books.
+func checkIndexPage(body []byte, parser IndexPageParser) (string, error) {
+	booksURLs, err := parser.Parse(bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("unparseable: %v", err)
+	}
+
+	books := 0
+	for _, bookURL := range booksURLs {
+		if PageKindOf(StandardEbooksMainURL.ResolveReference(bookURL).String()) == BookPageKind {
+			books++
+		}
+	}
+	if books == 0 {
+		return "", fmt.Errorf("no books found; the page layout may have changed")
+	}
+
+	return fmt.Sprintf("%d books", books), nil
+}
+
+// findCollectionLink returns the first link to a collection in a page.
+func findCollectionLink(htmlReader io.Reader) (*url.URL, error) {
+	doc, err := html.Parse(htmlReader)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *url.URL
+	var parseF func(n *html.Node)
+	parseF = func(n *html.Node) {
+		if found != nil {
+			return
+		}
+
+		if n.Type == html.ElementNode && n.Data == "a" {
+			for _, attr := range n.Attr {
+				if attr.Key == "href" && strings.HasPrefix(attr.Val, "/collections/") {
+					if u, err := url.Parse(attr.Val); err == nil {
+						found = u
+						return
+					}
+				}
+			}
+		}
+
+		// Recursive calls to do a depth-first search
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			parseF(c)
+		}
+	}
+
+	parseF(doc)
+
+	if found == nil {
+		return nil, fmt.Errorf("no link to a collection found; the page layout may have changed")
+	}
+
+	return found, nil
+}
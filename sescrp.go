@@ -1,17 +1,14 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 )
@@ -20,28 +17,123 @@ import (
 // in things like URL parsing.
 var StandardEbooksMainURL = MustParseURL("https://standardebooks.org")
 
-// Regular expressions used for things like URL validation and selection of appropiate
-// parsers.
-var (
-	StandardEbooksMainRegex = regexp.MustCompile(`https://standardebooks.org/.*[/]?$`)
-	EbookURLRegex           = regexp.MustCompile(`https://standardebooks.org/ebooks/[A-Za-z\-]+/.*[/]?$`)
-	AuthorURLRegex          = regexp.MustCompile(`https://standardebooks.org/ebooks/[A-Za-z\-]+[/]?$`)
-	CollectionURLRegex      = regexp.MustCompile(`https://standardebooks.org/collections/.*[/]?$`)
-)
-
 // Flag defaults
 var (
+	DefaultPreset         string = ""
 	DefaultBasedir        string = "."
+	DefaultStagingDir     string = ""
+	DefaultTempDir        string = ""
+	DefaultReadyMarkers   bool   = false
+	DefaultDurable        bool   = false
+	DefaultNoClobber      bool   = false
+	DefaultKeepVersions   bool   = false
+	DefaultResume         bool   = false
+	DefaultSkipExisting   bool   = false
+	DefaultNotify         bool   = false
 	DefaultConnectionWait int64  = 1
 	DefaultTrimKepub      bool   = false
+	DefaultFormatFallback string = ""
+	DefaultFallbackEpub   bool   = false
+	DefaultStrictFormats  bool   = false
+	DefaultAdaptiveWait   bool   = true
+	DefaultStallTimeout   int64  = 120
+	DefaultMaxPageSize    int64  = 10 * 1024 * 1024
+	DefaultFileWait       int64  = -1
+	DefaultConcurrency    int    = 1
+	DefaultSmallestFirst  bool   = false
+	DefaultHonorRobots    bool   = true
+	DefaultMaxBooks       int    = 100
+	DefaultAssumeYes      bool   = false
+	DefaultMinWords       int    = 0
+	DefaultMaxFiles       int    = 0
+	DefaultMaxBytes       int64  = 0
+	DefaultDeferredFile   string = ""
+	DefaultWindow         string = ""
+	DefaultReadingList    string = ""
+	DefaultShelf          string = ""
+	DefaultFirstMatch     bool   = false
+	DefaultMaxWords       int    = 0
+	DefaultConvert        string = ""
+	DefaultConverter      string = "ebook-convert"
+	DefaultPDFPageSize    string = ""
+	DefaultPprof          string = ""
+	DefaultCPUProfile     string = ""
+	DefaultHeapProfile    string = ""
+	DefaultTraceRequests  bool   = false
+	DefaultLogFile        string = ""
+	DefaultLogMaxSize     int64  = 10 * 1024 * 1024
+	DefaultLogKeep        int    = 5
+	DefaultTorrent        string = ""
+	DefaultLayout         string = ""
+	DefaultCheck          bool   = false
+	DefaultDryRun         bool   = false
+	DefaultKeepGoing      bool   = false
+	DefaultDoctor         bool   = false
+	DefaultFormatReport   bool   = false
+	DefaultSelfCheck      bool   = false
+	DefaultShowVersion    bool   = false
+	DefaultIPFSAPI        string = ""
+	DefaultIPFSCIDs       string = ""
 )
 
 // Flag variables
 var (
 	extensions     = flag.String("formats", strings.Join(FormatsTesters.GetKeys(), ","), "`extensions` to look for in files, separated by commas; by default, and as of this writing, all Standard Ebooks formats should be supported: Advanced Epub, Epub, Kepub, and Azw3")
+	preset         = flag.String("preset", DefaultPreset, "`device` preset selecting formats and naming rules in one go; one of "+strings.Join(PresetNames(), ", ")+" (kobo: kepub with trimmed extension; kindle: azw3; generic: epub); flags given explicitly take priority")
+	readingList    = flag.String("reading-list", DefaultReadingList, "CSV `file` exported from Goodreads or StoryGraph; each book is searched in Standard Ebooks and the best match, if any, is downloaded")
+	firstMatch     = flag.Bool("first", DefaultFirstMatch, "take the best match of every -get search without asking")
+	shelf          = flag.String("shelf", DefaultShelf, "only take books in this `shelf` of -reading-list, e. g. \"to-read\"")
 	basedir        = flag.String("dir", DefaultBasedir, "base `directory` where to download the files, and create it if necessary; a \".\" means the current directory")
+	stagingDir     = flag.String("staging-dir", DefaultStagingDir, "download and convert files in this `directory`, and move them into their final place only once every file of their book is done, so software watching the library never sees incomplete books; created if necessary")
+	tempDir        = flag.String("temp-dir", DefaultTempDir, "download files into this `directory`, and move each one to its final place once complete, e. g. to keep partial files on a fast local disk instead of network storage; created if necessary; can't be used with -staging-dir")
+	readyMarkers   = flag.Bool("ready-markers", DefaultReadyMarkers, "write an empty \"author_title"+ReadyMarkerExt+"\" file next to the files of every book once all of them are done (and moved, with -staging-dir), for software importing the library to wait for")
+	durable        = flag.Bool("durable", DefaultDurable, "flush the files of every book, and their directories, to disk once the book is complete (before any -ready-markers), so a power loss can't leave half-written files behind; slower")
+	noClobber      = flag.Bool("no-clobber", DefaultNoClobber, "never modify existing files in the library, only add new ones: downloading a file that already exists is an error, and existing conversions and -ready-markers are left alone; for shared archives")
+	keepVersions   = flag.Bool("keep-versions", DefaultKeepVersions, "instead of overwriting a downloaded file, keep the previous one with the date it was last modified added to its name, e. g. \"jane-austen_emma.2023-05-01.epub\"; can't be used with -no-clobber")
+	skipExisting   = flag.Bool("skip-existing", DefaultSkipExisting, "don't download files already in the library with the same size as in the server, checked with a HEAD request for each one found, e. g. to run again on the same inputs to only get what's missing")
+	resume         = flag.Bool("resume", DefaultResume, "keep the \".part\" file of a download that fails, and continue the ones left behind by an interrupted run where they stopped, if the server allows it and the file didn't change; otherwise they're downloaded again from the start")
 	connectionWait = flag.Int64("connection-wait", DefaultConnectionWait, "how many `seconds` to wait between *every* required HTTP connection, including parsing (*not* just between individual ebook file downloads); can be set to 0, but let's try to be nice to Standard Ebooks servers, if possible")
-	trimKepub      = flag.Bool("trim-kepub", DefaultTrimKepub, "download kepub files with the extension \".kepub\", instead of \".kepub.epub\"")
+	fileWait       = flag.Int64("file-wait", DefaultFileWait, "how many `seconds` to wait between file downloads and checks, if different from -connection-wait, which is then only used for pages; e. g. -connection-wait 1 -file-wait 10 resolves pages quickly but spaces out the heavier downloads; -1 means the same as -connection-wait")
+	concurrency    = flag.Int("concurrency", DefaultConcurrency, "download up to this `number` of files at once, and get as many book pages of author and collection pages; the waits between connections (see -connection-wait and -file-wait) then count between their starts, so the rate of requests stays the same, but slow transfers don't hold the next ones back")
+	smallestFirst  = flag.Bool("smallest-first", DefaultSmallestFirst, "download smaller books first, by the total size of their files, after the ones asked for explicitly, which are also sorted; the sizes are found with a HEAD request per file before starting")
+	adaptiveWait   = flag.Bool("adaptive-wait", DefaultAdaptiveWait, "automatically wait longer between connections when the server answers slowly or with 429/503 errors (which are retried), and recover gradually afterwards")
+	maxBooks       = flag.Int("max-books", DefaultMaxBooks, "ask for confirmation when author and collection pages add more than this `number` of books to the crawl, to avoid accidental full-site scrapes; 0 means no limit")
+	minWords       = flag.Int("min-words", DefaultMinWords, "only get books with at least this `number` of words; 0 means no limit")
+	maxWords       = flag.Int("max-words", DefaultMaxWords, "only get books with at most this `number` of words, e. g. 40000 for novellas and shorter; 0 means no limit")
+	assumeYes      = flag.Bool("yes", DefaultAssumeYes, "answer yes to every confirmation, e. g. for crawls over -max-books; needed when not running in a terminal")
+	honorRobots    = flag.Bool("robots", DefaultHonorRobots, "fetch and honor the robots.txt of every host contacted, including its Crawl-delay if longer than -connection-wait")
+	maxFiles       = flag.Int("max-files", DefaultMaxFiles, "stop after downloading this `number` of files in this run; 0 means no limit")
+	maxBytes       = flag.Int64("max-bytes", DefaultMaxBytes, "stop after downloading this many `bytes` in this run (files already started when crossing the limit are still finished); 0 means no limit")
+	deferredFile   = flag.String("deferred-file", DefaultDeferredFile, "when a quota stops the run, write the pages of the books with files left to download to this `file`, which can be given to -in later")
+	window         = flag.String("window", DefaultWindow, "only download files within this daily `window` of local time, e. g. \"01:00-06:00\"; pages are still resolved right away, but downloads wait for the window to open")
+	maxPageSize    = flag.Int64("max-page-size", DefaultMaxPageSize, "refuse to parse pages over this many `bytes`, e. g. a file got as a page by mistake; 0 means no limit")
+	stallTimeout   = flag.Int64("stall-timeout", DefaultStallTimeout, "abort and retry a download after this many `seconds` without receiving any data, and fail any request whose response doesn't start within them; 0 disables it")
+	formatFallback = flag.String("format-fallback", DefaultFormatFallback, "fallback `chains` like \"kepub>epub\": books that don't offer the first format get the next available one instead; several chains can be separated by commas, e. g. \"kepub>epub,azw3>epub\"; the first format of each chain should be in -formats")
+	fallbackEpub   = flag.Bool("fallback-epub", DefaultFallbackEpub, "get the plain epub of books that don't offer some of the requested formats")
+	strictFormats  = flag.Bool("strict-formats", DefaultStrictFormats, "treat every requested format a book doesn't offer as an error, exiting with a non-zero code at the end of the run, even if a fallback was found")
+	trimKepub      = flag.Bool("trim-kepub", DefaultTrimKepub, "download kepub files with the extension \".kepub\", instead of \".kepub.epub\"; applied before any -rename rule")
+	convert        = flag.String("convert", DefaultConvert, "extra `extensions` to produce from each downloaded epub with an external converter, separated by commas (e. g. \"mobi,pdf\"); conversions already done are not repeated, and epubs skipped by -skip-existing still get the ones they're missing; requires the epub format")
+	converter      = flag.String("converter", DefaultConverter, "external `program` used by -convert; one of \"ebook-convert\" (Calibre) or \"pandoc\"")
+	pdfPageSize    = flag.String("pdf-page-size", DefaultPDFPageSize, "paper `size` for PDFs produced by -convert, e. g. \"a4\" or \"letter\"; by default, the converter decides")
+	pprofAddr      = flag.String("pprof", DefaultPprof, "serve the net/http/pprof handlers on this `address`, e. g. \":6060\", for diagnosing performance issues")
+	cpuProfile     = flag.String("cpuprofile", DefaultCPUProfile, "write a CPU profile of the whole run to `file`")
+	heapProfile    = flag.String("heapprofile", DefaultHeapProfile, "write a heap profile to `file` at the end of the run")
+	check          = flag.Bool("check", DefaultCheck, "dry run: download nothing; instead, compare every file with the library using HEAD requests, log which ones would be new or updated, and print the pages of their books in the format of -in")
+	keepGoing      = flag.Bool("keep-going", DefaultKeepGoing, "when a search fails, a page can't be got or parsed, or a file checked, downloaded, converted, added to IPFS or moved out of -staging-dir, go on with the rest instead of stopping; every failure is listed at the end of the run, which then exits with a non-zero code")
+	dryRun         = flag.Bool("dry-run", DefaultDryRun, "resolve every page, then print the URL of each file that would be downloaded (after -skip-existing, if given) and the file it would be saved to, separated by a tab, and exit without downloading anything")
+	doctor         = flag.Bool("doctor", DefaultDoctor, "check the base directory, proxy configuration and connectivity to Standard Ebooks, print the findings, and exit")
+	layout         = flag.String("layout", DefaultLayout, "`name` of the layout of author and collection pages, one of "+strings.Join(IndexLayoutNames(), ", ")+"; by default it's detected in each page, but it can be pinned if detection fails after a site redesign")
+	formatReport   = flag.Bool("format-report", DefaultFormatReport, "list the books in -dir and the -format-dir directories found in more than one format, flagging formats not in -formats (e. g. an azw3 when only epub is wanted), and exit; the exit code is 1 if any was flagged")
+	selfCheck      = flag.Bool("selfcheck", DefaultSelfCheck, "get a known book, author and collection page, check that they can still be parsed as expected, print the findings, and exit; a failure probably means Standard Ebooks changed its pages")
+	showVersion    = flag.Bool("version", DefaultShowVersion, "print version and build information, and exit")
+	torrentFile    = flag.String("torrent", DefaultTorrent, "at the end of the run, write a .torrent `file` of everything in -dir, and log its magnet link, for sharing the archive; see -torrent-tracker and -torrent-webseed")
+	ipfsAPI        = flag.String("ipfs-api", DefaultIPFSAPI, "add and pin every downloaded or converted file in the IPFS node with its RPC API at this `URL`, e. g. \"http://127.0.0.1:5001\", logging their CIDs")
+	ipfsCIDs       = flag.String("ipfs-cids", DefaultIPFSCIDs, "append the CID and name of every file added by -ipfs-api to this `file`, one per line separated by a tab")
+	notify         = flag.Bool("notify", DefaultNotify, "show a desktop notification summarizing the run once it finishes, e. g. when started from a desktop shortcut; uses notify-send on Linux, osascript on macOS and PowerShell on Windows")
+	logFile        = flag.String("log-file", DefaultLogFile, "append the log to this `file` instead of the standard error, rotating it as set by -log-max-size and -log-keep")
+	logMaxSize     = flag.Int64("log-max-size", DefaultLogMaxSize, "rotate the -log-file once it grows over this many `bytes`; 0 never rotates it")
+	logKeep        = flag.Int("log-keep", DefaultLogKeep, "`number` of rotated log files to keep, e. g. \"sescrp.log.1\" to \"sescrp.log.5\"; older ones are deleted")
+	traceRequests  = flag.Bool("trace-requests", DefaultTraceRequests, "log DNS, connection, TLS, time to first byte and transfer timings for every HTTP request, to help tell slow servers from local network problems")
 )
 
 func main() {
@@ -50,47 +142,183 @@ func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [FLAGS] URL [URL...]\n\n", filepath.Base(os.Args[0]))
 		fmt.Fprintf(flag.CommandLine.Output(), "Scrap ebook files from Standard Ebooks.\n\n")
-		fmt.Fprintf(flag.CommandLine.Output(), "As of this date, Standard Ebooks robots.txt is intentionally left blank (ha!), which is great on their part. Nevertheless, in consideration of not being an abusive scrapper, an effort was made to keep all connections one at a time and with a timer between them.\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "URLs can be shortened to the path of a book, author or collection, e. g. \"jane-austen/pride-and-prejudice\", \"agatha-christie\" or \"collections/the-modern-library\".\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Every flag can also be set with an environment variable named after it, e. g. %s for -connection-wait; flags given in the command line take priority.\n\n", EnvName("connection-wait"))
+		fmt.Fprintf(flag.CommandLine.Output(), "As of this date, Standard Ebooks robots.txt is intentionally left blank (ha!), which is great on their part; it's honored nevertheless, in case that ever changes. Also in consideration of not being an abusive scrapper, an effort was made to keep all connections one at a time and with a timer between them.\n\n")
 
 		flag.PrintDefaults()
 	}
 
 	// Process urls in text files
-	urlsToProcess := make([]string, 0)
-	flag.Func("in", "`file` with links to process; one link per line", func(filename string) error {
-		f, err := os.Open(filename)
+	inputs := make([]Input, 0)
+	readInputFiles := make(map[string]struct{})
+	flag.Func("in", "`file` with links to process; one link per line, optionally followed by options like \"formats=epub dir=SciFi\"; a line with only options applies them to the following ones, up to an empty line; \"#\" starts a comment; \"-\" reads from the standard input; can be a glob pattern like \"lists/*.txt\", and be repeated", func(pattern string) error {
+		filenames := []string{pattern}
+		if pattern != "-" {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return err
+			}
+
+			// A pattern matching nothing is most likely a missing file, and
+			// opening it will give the appropiate error
+			if len(matches) > 0 {
+				filenames = matches
+			}
+		}
+
+		for _, filename := range filenames {
+			// Each file is read only once, even if matched by several patterns
+			if _, ok := readInputFiles[filename]; ok {
+				continue
+			}
+			readInputFiles[filename] = struct{}{}
+
+			fileInputs, err := ReadInputFile(filename)
+			if err != nil {
+				return err
+			}
+
+			inputs = append(inputs, fileInputs...)
+		}
+
+		return nil
+	})
+
+	// Per-format destination directories
+	formatDirs := make(map[string]string)
+	flag.Func("format-dir", "`format=directory` to save files of that format somewhere other than -dir, e. g. \"kepub=/mnt/kobo/books\"; can be repeated for several formats", func(value string) error {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return fmt.Errorf("expected format=directory, got \"%s\"", value)
+		}
+
+		if _, ok := FormatsTesters[parts[0]]; !ok {
+			return fmt.Errorf("the extension \"%s\" is not supported", parts[0])
+		}
+
+		formatDirs[parts[0]] = parts[1]
+
+		return nil
+	})
+
+	// Output filename rules
+	renameRules := make([]RenameRule, 0)
+	flag.Func("rename", "`pattern=replacement` rule for the names of downloaded files, where pattern is a regular expression and replacement can use submatches like \"$1\", e. g. \"_advanced\\.epub$=.advanced.epub\"; can be repeated, and rules are applied in order", func(value string) error {
+		rule, err := ParseRenameRule(value)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
 
-		scanner := bufio.NewScanner(bufio.NewReader(f))
-		var line string
-		for scanner.Scan() {
-			line = scanner.Text()
-			if line != "" {
-				urlsToProcess = append(urlsToProcess, line)
-			}
+		renameRules = append(renameRules, rule)
+
+		return nil
+	})
+
+	// Torrent trackers and web seeds
+	torrentOpts := TorrentOptions{}
+	flag.Func("torrent-tracker", "announce `URL` of a tracker for -torrent; can be repeated, in order of preference", func(value string) error {
+		_, err := url.ParseRequestURI(value)
+		if err != nil {
+			return err
 		}
-		err = scanner.Err()
+
+		torrentOpts.Trackers = append(torrentOpts.Trackers, value)
+
+		return nil
+	})
+	flag.Func("torrent-webseed", "`URL` where the contents of -dir are also served over HTTP, as a web seed for -torrent; can be repeated", func(value string) error {
+		_, err := url.ParseRequestURI(value)
 		if err != nil {
 			return err
 		}
 
+		torrentOpts.WebSeeds = append(torrentOpts.WebSeeds, value)
+
+		return nil
+	})
+
+	// Free-text searches
+	getQueries := make([]string, 0)
+	flag.Func("get", "search Standard Ebooks for this `text` (title, author, or both) and download the chosen match, e. g. \"moby dick\"; can be repeated", func(query string) error {
+		if strings.TrimSpace(query) == "" {
+			return fmt.Errorf("empty search")
+		}
+
+		getQueries = append(getQueries, query)
+
 		return nil
 	})
 
 	flag.Parse()
 
+	err := ApplyEnvironment()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *showVersion {
+		fmt.Println(VersionString())
+		os.Exit(0)
+	}
+
+	var logRotating *RotatingFile
+	if *logFile != "" {
+		if *logMaxSize < 0 || *logKeep < 0 {
+			fmt.Fprintf(os.Stderr, "error: log rotation settings can't be negative numbers\n")
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		logRotating, err = OpenRotatingFile(*logFile, *logMaxSize, *logKeep)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.SetOutput(logRotating)
+	}
+
+	nothingGiven := len(inputs) == 0 && len(flag.Args()) == 0 && len(getQueries) == 0 && *readingList == "" && !*doctor && !*selfCheck && !*formatReport
+
+	// With nothing else to do, take links piped through the standard input
+	if info, err := os.Stdin.Stat(); nothingGiven && err == nil && info.Mode()&os.ModeCharDevice == 0 {
+		inputs, err = ReadInputList(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// No arguments and no urls to process are equivalent to invoking help
-	if len(urlsToProcess) == 0 && len(flag.Args()) == 0 {
+	if len(inputs) == 0 && len(flag.Args()) == 0 && len(getQueries) == 0 && *readingList == "" && !*doctor && !*selfCheck && !*formatReport {
 		flag.Usage()
 		os.Exit(0)
 	}
 
 	// Concatenate all command line urls with the files. Give priority to command-line
 	// urls
-	urlsToProcess = append(flag.Args(), urlsToProcess...)
+	argInputs := make([]Input, 0, len(flag.Args()))
+	for _, arg := range flag.Args() {
+		argInputs = append(argInputs, Input{URL: arg})
+	}
+	inputs = append(argInputs, inputs...)
+	for i := range inputs {
+		inputs[i].URL = CanonicalPageURL(ExpandShorthand(inputs[i].URL))
+	}
+
+	if *preset != "" {
+		err = ApplyPreset(*preset)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	if *trimKepub {
+		renameRules = append([]RenameRule{TrimKepubRule}, renameRules...)
+	}
 
 	if *connectionWait < 0 {
 		fmt.Fprintf(os.Stderr, "error: time between connections can't be a negative number\n")
@@ -99,13 +327,71 @@ func main() {
 	}
 	duration := time.Duration(*connectionWait) * time.Second
 
+	if *fileWait < -1 {
+		fmt.Fprintf(os.Stderr, "error: time between file downloads can't be a negative number, other than -1\n")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *concurrency < 1 {
+		fmt.Fprintf(os.Stderr, "error: concurrency must be at least 1\n")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fileDuration := duration
+	if *fileWait >= 0 {
+		fileDuration = time.Duration(*fileWait) * time.Second
+	}
+
+	if *maxPageSize < 0 {
+		fmt.Fprintf(os.Stderr, "error: maximum page size can't be a negative number\n")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *stallTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "error: stall timeout can't be a negative number\n")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var fallbacks map[string][]string
+	if *formatFallback != "" {
+		fallbacks, err = ParseFallbacks(*formatFallback)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	var pageLayout *IndexLayout
+	if *layout != "" {
+		pageLayout, err = IndexLayoutByName(*layout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	var downloadWindow *TimeWindow
+	if *window != "" {
+		tw, err := ParseTimeWindow(*window)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			flag.Usage()
+			os.Exit(2)
+		}
+		downloadWindow = &tw
+	}
+
 	if *basedir == "" {
 		fmt.Fprintf(os.Stderr, "error: base directory can't be empty\n")
 		flag.Usage()
 		os.Exit(2)
 	}
 
-	var err error
 	*basedir, err = filepath.Abs(*basedir)
 	if err != nil {
 		log.Fatal(err)
@@ -115,47 +401,772 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Client to use in the connections
-	client := &http.Client{}
+	if *noClobber && *keepVersions {
+		fmt.Fprintf(os.Stderr, "error: -keep-versions can't be used with -no-clobber, which forbids renaming existing files\n")
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	// Timer initially set to expire inmediately
-	timer := time.NewTimer(0)
-	urls, err := NormalizeURLs(urlsToProcess, *extensions, duration, timer, client)
+	if *stagingDir != "" && *tempDir != "" {
+		fmt.Fprintf(os.Stderr, "error: -temp-dir can't be used with -staging-dir, which already keeps files out of the library until done\n")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	for _, dir := range []*string{stagingDir, tempDir} {
+		if *dir == "" {
+			continue
+		}
+
+		*dir, err = filepath.Abs(*dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = os.MkdirAll(*dir, os.ModePerm)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for format, dir := range formatDirs {
+		dir, err = filepath.Abs(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		formatDirs[format] = dir
+	}
+
+	if *formatReport {
+		libraryDirs := []string{*basedir}
+		for _, format := range FormatsTesters.GetKeys() {
+			if dir, ok := formatDirs[format]; ok {
+				libraryDirs = append(libraryDirs, dir)
+			}
+		}
+
+		books, err := ScanLibrary(libraryDirs)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(PrintFormatReport(os.Stdout, books, strings.Split(*extensions, ",")))
+	}
+
+	// Per-input directories, relative to -dir
+	inputDirs := make([]string, 0)
+	for _, input := range inputs {
+		if input.Options.Dir == "" {
+			continue
+		}
+
+		dir := input.Options.Dir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(*basedir, dir)
+		}
+		err = os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		inputDirs = append(inputDirs, dir)
+	}
+
+	// All output directories are checked before any connection is made, listing
+	// every problem at once
+	outputDirs := []string{*basedir}
+	for _, dir := range []string{*stagingDir, *tempDir} {
+		if dir != "" {
+			outputDirs = append(outputDirs, dir)
+		}
+	}
+	for _, format := range FormatsTesters.GetKeys() {
+		if dir, ok := formatDirs[format]; ok {
+			outputDirs = append(outputDirs, dir)
+		}
+	}
+	outputDirs = append(outputDirs, inputDirs...)
+	if problems := CheckWritableDirs(outputDirs); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Printf("error: %v", problem)
+		}
+		log.Fatalf("%d output directories can't be written to", len(problems))
+	}
+
+	var conv *Converter
+	if *convert != "" {
+		conv, err = NewConverter(*converter, *convert, ConvertOptions{PDFPageSize: *pdfPageSize, NoClobber: *noClobber})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		if !strings.Contains(","+*extensions+",", ",epub,") {
+			fmt.Fprintf(os.Stderr, "error: -convert requires the epub format to be downloaded\n")
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	profiler, err := StartProfiling(*pprofAddr, *cpuProfile, *heapProfile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for _, ebookURL := range urls.ToSlice() {
-		func(ebookURL *url.URL) {
-			ebookURL = StandardEbooksMainURL.ResolveReference(ebookURL)
+	// From here on, every exit goes through exit or fatal, which finish the
+	// profiles and close the files being written first
+	var cidsFile *os.File
+	exit := func(code int) {
+		err := profiler.Stop()
+		if err != nil {
+			log.Print(err)
+			code = 1
+		}
+
+		if cidsFile != nil {
+			cidsFile.Close()
+		}
+		if logRotating != nil {
+			logRotating.Close()
+		}
+
+		os.Exit(code)
+	}
+	fatal := func(v ...interface{}) {
+		log.Print(v...)
+		exit(1)
+	}
+
+	// Client to use in the connections. A server that takes the connection but
+	// never answers counts as stalled too, for pages as well as files.
+	baseTransport := http.DefaultTransport.(*http.Transport).Clone()
+	baseTransport.ResponseHeaderTimeout = time.Duration(*stallTimeout) * time.Second
+	var transport http.RoundTripper = baseTransport
+	if *traceRequests {
+		transport = &TracingTransport{Transport: transport}
+	}
+	client := &http.Client{
+		Transport: &UserAgentTransport{Transport: transport},
+	}
 
-			filename := path.Base(ebookURL.String())
+	var ipfs *IPFSClient
+	if *ipfsAPI != "" {
+		ipfs, err = NewIPFSClient(*ipfsAPI, &http.Client{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			flag.Usage()
+			exit(2)
+		}
 
-			if *trimKepub && strings.HasSuffix(filename, ".kepub.epub") {
-				filename = strings.TrimSuffix(filename, ".epub")
+		if *ipfsCIDs != "" {
+			cidsFile, err = os.OpenFile(*ipfsCIDs, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+			if err != nil {
+				fatal(err)
 			}
+		}
+	}
+
+	var robots *RobotsCache
+	if *honorRobots {
+		robots = NewRobotsCache()
+	}
+	pacer := NewPacer(duration, *adaptiveWait, robots)
+	// Book pages of author and collection pages are got concurrently too
+	pacer.SetOverlapping(*concurrency > 1)
 
-			absFilename := filepath.Join(*basedir, filename)
+	// Files get their own pacer if their wait is different, or if they're
+	// downloaded concurrently
+	filePacer := pacer
+	if fileDuration != duration || *concurrency > 1 {
+		filePacer = NewPacer(fileDuration, *adaptiveWait, robots)
+		filePacer.SetOverlapping(*concurrency > 1)
+		filePacer.SetFollows(pacer)
+	}
+
+	if *doctor {
+		exit(PrintFindings(RunDoctor(*basedir, pacer, client)))
+	}
+
+	if *selfCheck {
+		exit(PrintFindings(RunSelfCheck(*maxPageSize, pacer, client)))
+	}
+
+	// Everything notable found along the run, reported at the end
+	report := &NormalizeReport{}
+
+	// With -keep-going, records a failure and returns, instead of exiting
+	fail := func(rawURL string, phase string, err error) {
+		if !*keepGoing {
+			fatal(err)
+		}
 
-			f, err := os.Create(absFilename)
+		log.Printf("error: %v; going on with the rest", err)
+		report.Failures = append(report.Failures, Failure{URL: rawURL, Phase: phase, Err: err})
+	}
+	failItem := func(item QueueItem, phase string, err error) {
+		fail(StandardEbooksMainURL.ResolveReference(item.URL).String(), phase, err)
+	}
+
+	for _, query := range getQueries {
+		booksURLs, err := Search(query, *maxPageSize, pacer, client)
+		if err != nil {
+			fail(SearchURL(query), "search", err)
+			continue
+		}
+
+		if len(booksURLs) == 0 {
+			log.Printf("no match for \"%s\"", query)
+			continue
+		}
+
+		candidates := make([]string, 0, MaxSearchCandidates)
+		for _, bookURL := range booksURLs {
+			if len(candidates) == MaxSearchCandidates {
+				break
+			}
+			candidates = append(candidates, StandardEbooksMainURL.ResolveReference(bookURL).String())
+		}
+
+		choice := 0
+		if !*firstMatch && len(candidates) > 1 {
+			var ok bool
+			choice, ok = Choose(fmt.Sprintf("matches for \"%s\":", query), candidates)
+			if !ok {
+				log.Printf("no match chosen for \"%s\"; use -first to take the best one without asking", query)
+				continue
+			}
+		}
+
+		log.Printf("matched \"%s\" to %s", query, candidates[choice])
+		inputs = append(inputs, Input{URL: candidates[choice]})
+	}
+
+	if *readingList != "" {
+		entries, err := ReadReadingList(*readingList, *shelf)
+		if err != nil {
+			fatal(err)
+		}
+
+		matched := 0
+		for _, entry := range entries {
+			booksURLs, err := Search(entry.Query(), *maxPageSize, pacer, client)
+			if err != nil {
+				fail(SearchURL(entry.Query()), "search", err)
+				continue
+			}
+
+			if len(booksURLs) == 0 {
+				log.Printf("no match for \"%s\" by %s", entry.Title, entry.Author)
+				continue
+			}
+
+			bookURL := StandardEbooksMainURL.ResolveReference(booksURLs[0])
+			log.Printf("matched \"%s\" by %s to %s", entry.Title, entry.Author, bookURL)
+			inputs = append(inputs, Input{URL: bookURL.String()})
+			matched++
+		}
+		log.Printf("matched %d of %d books in %s", matched, len(entries), *readingList)
+	}
+
+	normalizeOpts := NormalizeOptions{
+		Formats:      *extensions,
+		MinWords:     *minWords,
+		MaxWords:     *maxWords,
+		Fallbacks:    fallbacks,
+		FallbackEpub: *fallbackEpub,
+		Layout:       pageLayout,
+		MaxPageSize:  *maxPageSize,
+		KeepGoing:    *keepGoing,
+		Concurrency:  *concurrency,
+		// Shared by every group
+		Crawl: &CrawlBudget{
+			MaxBooks: *maxBooks,
+			Confirm: func(rawURL string, books int) bool {
+				if *assumeYes {
+					return true
+				}
+
+				return Confirm(fmt.Sprintf("%s takes the crawl to %d books (more than -max-books %d); continue?", rawURL, books, *maxBooks))
+			},
+		},
+	}
+
+	books, indexes := CountInputKinds(inputs)
+	if indexes > 0 {
+		log.Printf("resolving %d book pages and %d author or collection pages (and their books): at least %v", books, indexes, EstimateRun(books+indexes, duration))
+	} else {
+		log.Printf("resolving %d book pages: %v", books, EstimateRun(books, duration))
+	}
+
+	// Each group of inputs sharing the same options is resolved on its own, but the
+	// books explicitly asked for in every group come first, as within a group, and
+	// then the author and collection pages
+	groups := GroupInputs(inputs)
+	queue := make([]QueueItem, 0)
+	queued := make(map[string]bool)
+	for _, booksPass := range []bool{true, false} {
+		for _, group := range groups {
+			groupURLs := make([]string, 0, len(group.URLs))
+			for _, rawURL := range group.URLs {
+				if (PageKindOf(rawURL) == BookPageKind) == booksPass {
+					groupURLs = append(groupURLs, rawURL)
+				}
+			}
+			if len(groupURLs) == 0 {
+				continue
+			}
+
+			groupOpts := normalizeOpts
+			if group.Options.Formats != "" {
+				groupOpts.Formats = group.Options.Formats
+			}
+
+			dir := ""
+			if group.Options.Dir != "" {
+				dir = group.Options.Dir
+				if !filepath.IsAbs(dir) {
+					dir = filepath.Join(*basedir, dir)
+				}
+
+				err = os.MkdirAll(dir, os.ModePerm)
+				if err != nil {
+					fatal(err)
+				}
+			}
+
+			urls, groupReport, err := NormalizeURLs(groupURLs, groupOpts, pacer, client)
+			if err != nil {
+				fatal(err)
+			}
+			report.Merge(groupReport)
+
+			// A book asked for explicitly may also be found again through an
+			// author or collection page
+			for _, ebookURL := range urls.ToSlice() {
+				key := dir + "\x00" + ebookURL.String()
+				if queued[key] {
+					continue
+				}
+				queued[key] = true
+
+				queue = append(queue, QueueItem{
+					URL:      ebookURL,
+					Format:   urls.Format(ebookURL),
+					Dir:      dir,
+					Options:  group.Options,
+					Explicit: booksPass,
+				})
+			}
+		}
+	}
+
+	downloader := NewDownloader(DownloaderOptions{
+		Basedir:      *basedir,
+		FormatDirs:   formatDirs,
+		StagingDir:   *stagingDir,
+		TempDir:      *tempDir,
+		RenameRules:  renameRules,
+		NoClobber:    *noClobber,
+		KeepVersions: *keepVersions,
+		Resume:       *resume,
+		StallTimeout: time.Duration(*stallTimeout) * time.Second,
+	}, filePacer, client)
+
+	// The final file names are only known once the book pages are resolved, but
+	// still before downloading anything
+	if problems := CheckFilenames(queue, downloader.Filename); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Printf("error: %v", problem)
+		}
+		fatal(fmt.Sprintf("%d problems with the names of the files to download", len(problems)))
+	}
+
+	skipped := 0
+	var skippedItems []QueueItem
+	if *skipExisting && !*check {
+		remaining := make([]QueueItem, 0, len(queue))
+		for _, item := range queue {
+			existing, err := downloader.Existing(item)
+			if err != nil {
+				failItem(item, "check", err)
+				continue
+			}
+
+			if existing {
+				log.Printf("skipped %s: already in the library with the same size", downloader.Filename(item))
+				skipped++
+				skippedItems = append(skippedItems, item)
+			} else {
+				remaining = append(remaining, item)
+			}
+		}
+		queue = remaining
+	}
+
+	if *smallestFirst && !*check {
+		log.Printf("checking the size of %d files", len(queue))
+		queue = SmallestBooksFirst(queue, func(item QueueItem) int64 {
+			size, err := downloader.Size(item)
+			if err != nil {
+				log.Printf("warning: %v; downloading its book last", err)
+				return -1
+			}
+
+			return size
+		})
+	}
+
+	if *dryRun {
+		for _, item := range queue {
+			fmt.Printf("%s\t%s\n", StandardEbooksMainURL.ResolveReference(item.URL), downloader.Filename(item))
+		}
+		log.Printf("%d files would be downloaded", len(queue))
+		if *skipExisting {
+			log.Printf("skipped %d files already in the library", skipped)
+		}
+		logPacerStats(pacer, filePacer)
+		logFailures(report.Failures)
+		if len(report.Failures) > 0 {
+			exit(1)
+		}
+		exit(0)
+	}
+
+	if !*check {
+		estimate := EstimateRun(len(queue), fileDuration)
+		log.Printf("downloading %d files: %v", len(queue), estimate)
+		if estimate.Pacing > LongRunWarning {
+			log.Printf("warning: this run will take more than %v only waiting between connections; consider -max-files or -window to spread it", estimate.Pacing.Round(time.Minute))
+		}
+	}
+
+	if *check {
+		outdated := make([]QueueItem, 0)
+		counts := make(map[FileStatus]int)
+		for _, item := range queue {
+			status, err := downloader.Compare(item)
+			if err != nil {
+				failItem(item, "check", err)
+				continue
+			}
+			counts[status]++
+
+			if status != FileUpToDate {
+				log.Printf("%s %s", status, downloader.Filename(item))
+				outdated = append(outdated, item)
+			}
+		}
+		log.Printf("%d files would be downloaded (%d new, %d updated), %d are up to date", len(outdated), counts[FileNew], counts[FileUpdated], counts[FileUpToDate])
+		logPacerStats(pacer, filePacer)
+
+		err = PrintInputList(os.Stdout, BookInputs(outdated))
+		if err != nil {
+			fatal(err)
+		}
+
+		logFailures(report.Failures)
+		if len(report.Failures) > 0 {
+			exit(1)
+		}
+		exit(0)
+	}
+
+	var stager *Stager
+	if *stagingDir != "" || *readyMarkers || *durable {
+		stager = &Stager{
+			ReadyMarkers: *readyMarkers,
+			Durable:      *durable,
+			NoClobber:    *noClobber,
+			KeepVersions: *keepVersions,
+		}
+	}
+
+	pool := NewDownloadPool(downloader)
+	var deferred []QueueItem
+	bookStart := 0
+	bookFailed := false
+	next := 0 // Next item to start downloading
+	for i, item := range queue {
+		// The files of each book are together in the queue, so a book is complete
+		// once the next file is from another one
+		if i > 0 && BookURLOf(item.URL).String() != BookURLOf(queue[i-1].URL).String() {
+			bookStart = i
+
+			// A book with failed files is never marked as complete
+			if stager != nil && bookFailed {
+				log.Printf("leaving %d files of a book with failed files unfinished", stager.Drop())
+			}
+			bookFailed = false
+
+			if stager != nil {
+				bookURL := BookURLOf(queue[i-1].URL)
+				err = stager.Commit(bookURL)
+				if err != nil {
+					fail(StandardEbooksMainURL.ResolveReference(bookURL).String(), "move", err)
+					log.Printf("leaving %d files of a book that couldn't be moved unfinished", stager.Drop())
+				}
+			}
+		}
+
+		// Keep up to -concurrency downloads going, started in order, until a
+		// quota is reached. Every file started is finished, and counts for
+		// -max-files right away.
+		for ; deferred == nil && next < len(queue) && next < i+*concurrency; next++ {
+			if (*maxFiles > 0 && next >= *maxFiles) || (*maxBytes > 0 && downloader.Stats().Bytes >= *maxBytes) {
+				deferred = queue[next:]
+				break
+			}
+
+			if downloadWindow != nil {
+				if wait := downloadWindow.Until(time.Now()); wait > 0 {
+					log.Printf("outside of the download window %s, waiting %v", *window, wait.Round(time.Second))
+					downloadWindow.Wait()
+				}
+			}
+
+			pool.Start(queue[next])
+		}
+
+		// The quota was reached, and every file started is done
+		if pool.Pending() == 0 {
+			// An incomplete book stays in the staging directory, and is deferred
+			// as a whole
+			if stager != nil && stager.Len() > 0 {
+				log.Printf("leaving %d files of an incomplete book unfinished", stager.Len())
+				deferred = queue[bookStart:]
+			}
+			break
+		}
+
+		absFilename, err := pool.Next()
+		if err != nil {
+			failItem(item, "download", err)
+			bookFailed = true
+			continue
+		}
+
+		// Without a staging directory, the file is already in its final place
+		var finalDir string
+		if stager != nil {
+			finalFilename := downloader.Filename(item)
+			finalDir = filepath.Dir(finalFilename)
+			stager.Add(absFilename, finalFilename)
+		}
+
+		var produced []string
+		if conv != nil && conv.CanConvert(absFilename) {
+			log.Printf("converting %s to %s", absFilename, *convert)
+			produced, err = conv.Convert(absFilename, downloader.Filename(item))
 			if err != nil {
-				log.Fatal(err)
+				failItem(item, "convert", err)
+				bookFailed = true
 			}
-			defer f.Close()
 
-			<-timer.C
+			if stager != nil {
+				for _, output := range produced {
+					stager.Add(output, filepath.Join(finalDir, filepath.Base(output)))
+				}
+			}
+		}
+
+		if ipfs != nil {
+			for _, filename := range append([]string{absFilename}, produced...) {
+				cid, err := ipfs.Add(filename)
+				if err != nil {
+					failItem(item, "add to IPFS", err)
+					continue
+				}
+				log.Printf("added %s to IPFS as %s", filename, cid)
 
-			log.Printf("downloading %s to %s", ebookURL, absFilename)
-			resp, err := client.Get(ebookURL.String())
+				if cidsFile != nil {
+					_, err = fmt.Fprintf(cidsFile, "%s\t%s\n", cid, filepath.Base(filename))
+					if err != nil {
+						fatal(err)
+					}
+				}
+			}
+		}
+	}
+
+	if stager != nil && bookFailed {
+		log.Printf("leaving %d files of a book with failed files unfinished", stager.Drop())
+	}
+	if stager != nil && deferred == nil && len(queue) > 0 {
+		bookURL := BookURLOf(queue[len(queue)-1].URL)
+		err = stager.Commit(bookURL)
+		if err != nil {
+			fail(StandardEbooksMainURL.ResolveReference(bookURL).String(), "move", err)
+			log.Printf("leaving %d files of a book that couldn't be moved unfinished", stager.Drop())
+		}
+	}
+
+	// Files already in the library still get the conversions they're missing,
+	// right next to them
+	if conv != nil {
+		for _, item := range skippedItems {
+			filename := downloader.Filename(item)
+			if !conv.CanConvert(filename) {
+				continue
+			}
+
+			produced, err := conv.Convert(filename, filename)
 			if err != nil {
-				log.Fatal(err)
+				failItem(item, "convert", err)
+			}
+			for _, output := range produced {
+				log.Printf("converted %s to %s", filename, output)
+			}
+		}
+	}
+
+	stats := downloader.Stats()
+	log.Printf("downloaded %d files, %d bytes in %v (%.1f KiB/s on average)", stats.Files, stats.Bytes, stats.Duration.Round(time.Millisecond), stats.Speed()/1024)
+	if *skipExisting {
+		log.Printf("skipped %d files already in the library", skipped)
+	}
+	logPacerStats(pacer, filePacer)
+
+	if *torrentFile != "" {
+		absTorrentFile, err := filepath.Abs(*torrentFile)
+		if err != nil {
+			fatal(err)
+		}
+		// Only the library itself is shared, without the files sescrp keeps next
+		// to it, nor the leftovers of failed downloads
+		torrentOpts.Exclude = append(torrentOpts.Exclude, absTorrentFile)
+		excluded := []string{*stagingDir, *tempDir, *ipfsCIDs, *deferredFile}
+		if *logFile != "" {
+			excluded = append(excluded, *logFile)
+			for i := 1; i <= *logKeep; i++ {
+				excluded = append(excluded, fmt.Sprintf("%s.%d", *logFile, i))
+			}
+		}
+		for _, filename := range excluded {
+			if filename == "" {
+				continue
 			}
-			defer resp.Body.Close()
 
-			io.Copy(f, resp.Body)
+			absFilename, err := filepath.Abs(filename)
+			if err != nil {
+				fatal(err)
+			}
+			torrentOpts.Exclude = append(torrentOpts.Exclude, absFilename)
+		}
+		torrentOpts.ExcludeExts = append(torrentOpts.ExcludeExts, ".part", ResumeValidatorExt, ".tmp")
+
+		torrent, err := MakeTorrent(*basedir, torrentOpts)
+		if err != nil {
+			fatal(err)
+		}
+		err = ioutil.WriteFile(absTorrentFile, torrent.Data, 0666)
+		if err != nil {
+			fatal(err)
+		}
+
+		log.Printf("wrote %s with %d files, %d bytes", absTorrentFile, torrent.Files, torrent.Bytes)
+		log.Printf("magnet link: %s", torrent.MagnetURI())
+	}
+
+	if len(report.Removed) > 0 {
+		log.Printf("%d books were removed upstream:", len(report.Removed))
+		for _, bookURL := range report.Removed {
+			log.Printf("removed %s", bookURL)
+		}
+	}
+
+	if len(report.Warnings) > 0 {
+		log.Printf("%d pages had problems that were skipped:", len(report.Warnings))
+		for _, warning := range report.Warnings {
+			log.Printf("warning: %s", warning)
+		}
+	}
+
+	// With strict formats, every unavailable format is an error
+	unavailableLabel := "unavailable"
+	if *strictFormats {
+		unavailableLabel = "error: unavailable"
+	}
+	if len(report.Unavailable) > 0 {
+		log.Printf("%d requested formats were not available:", len(report.Unavailable))
+		for _, unavailable := range report.Unavailable {
+			if unavailable.Fallback != "" {
+				log.Printf("%s %s in %s (got %s instead)", unavailableLabel, unavailable.Book, unavailable.Format, unavailable.Fallback)
+			} else {
+				log.Printf("%s %s in %s", unavailableLabel, unavailable.Book, unavailable.Format)
+			}
+		}
+	}
+
+	logFailures(report.Failures)
+
+	if len(deferred) > 0 {
+		log.Printf("download quota reached, %d files deferred:", len(deferred))
+		for _, item := range deferred {
+			log.Printf("deferred %s", StandardEbooksMainURL.ResolveReference(item.URL))
+		}
+
+		if *deferredFile != "" {
+			err = WriteInputList(*deferredFile, BookInputs(deferred))
+			if err != nil {
+				fatal(err)
+			}
+			log.Printf("deferred files saved to %s; pass it to -in to resume", *deferredFile)
+		}
+	}
+
+	if *notify {
+		summary := fmt.Sprintf("Downloaded %d files, %d bytes in %v.", stats.Files, stats.Bytes, stats.Duration.Round(time.Second))
+		if skipped > 0 {
+			summary += fmt.Sprintf(" %d already in the library.", skipped)
+		}
+		if len(deferred) > 0 {
+			summary += fmt.Sprintf(" %d deferred by the quota.", len(deferred))
+		}
+		if len(report.Unavailable) > 0 {
+			summary += fmt.Sprintf(" %d formats not available.", len(report.Unavailable))
+		}
+		if len(report.Failures) > 0 {
+			summary += fmt.Sprintf(" %d failures.", len(report.Failures))
+		}
+
+		err = Notify("sescrp finished", summary)
+		if err != nil {
+			log.Printf("warning: %v", err)
+		}
+	}
+
+	if len(report.Failures) > 0 || (*strictFormats && len(report.Unavailable) > 0) {
+		exit(1)
+	}
+	exit(0)
+}
+
+// logFailures logs every failure of a -keep-going run, one per line with its
+// phase, URL and error.
+func logFailures(failures []Failure) {
+	if len(failures) == 0 {
+		return
+	}
+
+	log.Printf("%d failures:", len(failures))
+	for _, failure := range failures {
+		log.Printf("failed\t%s\t%s\t%v", failure.Phase, failure.URL, failure.Err)
+	}
+}
 
-			timer.Reset(duration)
-		}(ebookURL)
+// logPacerStats logs the stats of the pacers for pages and files, which may be the
+// same one.
+func logPacerStats(pacer, filePacer *Pacer) {
+	if filePacer == pacer {
+		log.Printf("made %v", pacer.Stats())
+		return
 	}
 
+	log.Printf("pages: made %v", pacer.Stats())
+	log.Printf("files: made %v", filePacer.Stats())
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadyMarkerExt is the extension of the marker files written for complete books.
+const ReadyMarkerExt = ".ready"
+
+// Stager keeps track of the files of a book until they're all done, so they can
+// be moved into the library together from a staging directory, and be marked as
+// ready. This way, software watching the library never sees a book
+// half-downloaded.
+type Stager struct {
+	// ReadyMarkers writes an empty marker file for every complete book, named
+	// after it, e. g. "jane-austen_emma.ready", in every directory with files of
+	// the book.
+	ReadyMarkers bool
+	// Durable flushes every file of a complete book, and the directories they're
+	// in, to disk before writing the ready markers, so a power loss can't leave
+	// books marked as ready but not fully written.
+	Durable bool
+	// NoClobber refuses to replace existing files, and leaves existing ready
+	// markers alone.
+	NoClobber bool
+	// KeepVersions keeps the files that would be replaced by a different version,
+	// with KeepVersion.
+	KeepVersions bool
+
+	pending []stagedFile
+}
+
+// stagedFile is a file of a book not yet complete.
+type stagedFile struct {
+	staged string
+	final  string
+}
+
+// Add records a file of the current book, and the absolute filename it should be
+// moved to. Both names can be the same, if no staging directory is used.
+func (s *Stager) Add(staged, final string) {
+	s.pending = append(s.pending, stagedFile{staged: staged, final: final})
+}
+
+// Len returns the number of files waiting for their book to be complete.
+func (s *Stager) Len() int {
+	return len(s.pending)
+}
+
+// Drop forgets the pending files of the current book, e. g. because some of its
+// files failed, and returns how many there were. They're left where they are, and
+// no ready markers are written for the book.
+func (s *Stager) Drop() int {
+	n := len(s.pending)
+	s.pending = nil
+
+	return n
+}
+
+// Commit marks the current book, whose page is bookURL, as complete: every pending
+// file is moved to its final place, in the order they were added, flushed to disk
+// if Durable, and then the ready markers are written, if enabled. The files not
+// moved because of an error are kept pending.
+func (s *Stager) Commit(bookURL *url.URL) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	dirs := make([]string, 0, 1)
+	for i, file := range s.pending {
+		if file.staged != file.final {
+			move := MoveFile
+			if s.NoClobber {
+				move = MoveNewFile
+			}
+
+			if s.KeepVersions {
+				err := KeepVersion(file.final, file.staged)
+				if err != nil {
+					s.pending = s.pending[i:]
+					return err
+				}
+			}
+
+			err := move(file.staged, file.final)
+			if err != nil {
+				s.pending = s.pending[i:]
+				return err
+			}
+
+			log.Printf("moved %s to %s", file.staged, file.final)
+		}
+
+		if s.Durable {
+			err := SyncPath(file.final)
+			if err != nil {
+				s.pending = s.pending[i:]
+				return err
+			}
+		}
+
+		dirs = append(dirs, filepath.Dir(file.final))
+	}
+
+	s.pending = s.pending[:0]
+	dirs = RemoveStringDuplicates(dirs)
+
+	if s.Durable {
+		err := s.syncDirs(dirs)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !s.ReadyMarkers {
+		return nil
+	}
+
+	marker := ReadyMarkerName(bookURL)
+	for _, dir := range dirs {
+		err := writeMarker(filepath.Join(dir, marker), s.NoClobber)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Durable {
+		return s.syncDirs(dirs)
+	}
+
+	return nil
+}
+
+// syncDirs flushes the entries of the given directories to disk.
+func (s *Stager) syncDirs(dirs []string) error {
+	for _, dir := range dirs {
+		err := SyncPath(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeMarker writes an empty marker file, leaving an existing one alone if
+// noClobber.
+func writeMarker(filename string, noClobber bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if noClobber {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+
+	f, err := os.OpenFile(filename, flags, 0666)
+	if noClobber && os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// ReadyMarkerName returns the name of the ready marker of a book, given the URL of
+// its page, e. g. "jane-austen_emma.ready" for "/ebooks/jane-austen/emma".
+func ReadyMarkerName(bookURL *url.URL) string {
+	name := strings.Trim(bookURL.Path, "/")
+	name = strings.TrimPrefix(name, "ebooks/")
+
+	return strings.ReplaceAll(name, "/", "_") + ReadyMarkerExt
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits of the piece length of generated torrents, which grows with the size of
+// the archive to keep the number of pieces reasonable.
+const (
+	MinTorrentPieceLength = 256 * 1024
+	MaxTorrentPieceLength = 16 * 1024 * 1024
+	TargetTorrentPieces   = 1500
+)
+
+// TorrentOptions are the options of a generated torrent.
+type TorrentOptions struct {
+	// Trackers are the announce URLs, in order of preference.
+	Trackers []string
+	// WebSeeds are HTTP URLs where the same files can be downloaded from, as in
+	// BEP 19.
+	WebSeeds []string
+	// Exclude are absolute filenames, files or directories, left out of the
+	// torrent, e. g. the torrent file itself.
+	Exclude []string
+	// ExcludeExts are extensions of files left out of the torrent wherever they
+	// are, e. g. ".part" for unfinished downloads.
+	ExcludeExts []string
+}
+
+// Torrent is a generated .torrent file.
+type Torrent struct {
+	// Name is the name of the torrent, which is also the name of the directory
+	// its files are downloaded into.
+	Name string
+	// Files is the number of files in the torrent.
+	Files int
+	// Bytes is the total size of the files.
+	Bytes int64
+	// InfoHash is the SHA-1 of the info dictionary, which identifies the torrent.
+	InfoHash [sha1.Size]byte
+	// Data is the content of the .torrent file.
+	Data []byte
+
+	trackers []string
+}
+
+// MagnetURI returns a magnet link for the torrent, including its trackers.
+func (t *Torrent) MagnetURI() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "magnet:?xt=urn:btih:%s&dn=%s", hex.EncodeToString(t.InfoHash[:]), url.QueryEscape(t.Name))
+	for _, tracker := range t.trackers {
+		fmt.Fprintf(&b, "&tr=%s", url.QueryEscape(tracker))
+	}
+
+	return b.String()
+}
+
+// torrentEntry is a file to be included in a torrent.
+type torrentEntry struct {
+	absPath string
+	path    []string
+	length  int64
+}
+
+// MakeTorrent makes a multi-file torrent of every regular file under dir, named
+// after it. Hidden files and directories, e. g. those left by other programs, are
+// skipped.
+func MakeTorrent(dir string, opts TorrentOptions) (*Torrent, error) {
+	exclude := make(map[string]struct{}, len(opts.Exclude))
+	for _, excluded := range opts.Exclude {
+		exclude[excluded] = struct{}{}
+	}
+
+	files := make([]torrentEntry, 0)
+	var total int64
+	err := filepath.Walk(dir, func(absPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		_, excluded := exclude[absPath]
+		hidden := absPath != dir && strings.HasPrefix(info.Name(), ".")
+		if info.IsDir() {
+			if excluded || hidden {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		for _, ext := range opts.ExcludeExts {
+			excluded = excluded || strings.HasSuffix(info.Name(), ext)
+		}
+		if excluded || hidden || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, absPath)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, torrentEntry{
+			absPath: absPath,
+			path:    strings.Split(filepath.ToSlash(rel), "/"),
+			length:  info.Size(),
+		})
+		total += info.Size()
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files to make a torrent of in %s", dir)
+	}
+
+	pieceLength := int64(MinTorrentPieceLength)
+	for total/pieceLength > TargetTorrentPieces && pieceLength < MaxTorrentPieceLength {
+		pieceLength *= 2
+	}
+
+	pieces, err := hashPieces(files, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	fileList := make([]interface{}, 0, len(files))
+	for _, file := range files {
+		path := make([]interface{}, len(file.path))
+		for i, component := range file.path {
+			path[i] = component
+		}
+
+		fileList = append(fileList, map[string]interface{}{
+			"length": file.length,
+			"path":   path,
+		})
+	}
+
+	name := filepath.Base(dir)
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pieceLength,
+		"pieces":       pieces,
+		"files":        fileList,
+	}
+
+	var infoBuf bytes.Buffer
+	err = bencode(&infoBuf, info)
+	if err != nil {
+		return nil, err
+	}
+
+	metainfo := map[string]interface{}{
+		"info":          info,
+		"created by":    UserAgent(),
+		"creation date": time.Now().Unix(),
+	}
+	if len(opts.Trackers) > 0 {
+		metainfo["announce"] = opts.Trackers[0]
+
+		tiers := make([]interface{}, 0, len(opts.Trackers))
+		for _, tracker := range opts.Trackers {
+			tiers = append(tiers, []interface{}{tracker})
+		}
+		metainfo["announce-list"] = tiers
+	}
+	if len(opts.WebSeeds) > 0 {
+		seeds := make([]interface{}, 0, len(opts.WebSeeds))
+		for _, seed := range opts.WebSeeds {
+			seeds = append(seeds, seed)
+		}
+		metainfo["url-list"] = seeds
+	}
+
+	var buf bytes.Buffer
+	err = bencode(&buf, metainfo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Torrent{
+		Name:     name,
+		Files:    len(files),
+		Bytes:    total,
+		InfoHash: sha1.Sum(infoBuf.Bytes()),
+		Data:     buf.Bytes(),
+		trackers: opts.Trackers,
+	}, nil
+}
+
+// hashPieces returns the concatenated SHA-1 hashes of the pieces of the files, as
+// if they were a single stream of data.
+func hashPieces(files []torrentEntry, pieceLength int64) ([]byte, error) {
+	pieces := make([]byte, 0)
+	hash := sha1.New()
+	var inPiece int64
+
+	for _, file := range files {
+		f, err := os.Open(file.absPath)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			n, err := io.CopyN(hash, f, pieceLength-inPiece)
+			inPiece += n
+			if inPiece == pieceLength {
+				pieces = hash.Sum(pieces)
+				hash.Reset()
+				inPiece = 0
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("while hashing %s: %v", file.absPath, err)
+			}
+		}
+
+		f.Close()
+	}
+
+	if inPiece > 0 {
+		pieces = hash.Sum(pieces)
+	}
+
+	return pieces, nil
+}
+
+// bencode writes v in the encoding used by .torrent files. v can be a string,
+// []byte, int, int64, []interface{} or map[string]interface{}, recursively.
+func bencode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte(':')
+		buf.WriteString(v)
+	case []byte:
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte(':')
+		buf.Write(v)
+	case int:
+		fmt.Fprintf(buf, "i%de", v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, item := range v {
+			err := bencode(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		// Keys must be sorted as raw strings
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('d')
+		for _, key := range keys {
+			bencode(buf, key)
+			err := bencode(buf, v[key])
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("can't bencode a value of type %T", v)
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBencode(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{"spam", "4:spam"},
+		{"", "0:"},
+		{[]byte{0, 1, 2}, "3:\x00\x01\x02"},
+		{3, "i3e"},
+		{int64(-42), "i-42e"},
+		{[]interface{}{"spam", 1}, "l4:spami1ee"},
+		// Keys sorted as raw strings, so uppercase first and "piece length"
+		// before "pieces"
+		{map[string]interface{}{"pieces": "", "piece length": 1, "name": "x", "Z": 0}, "d1:Zi0e4:name1:x12:piece lengthi1e6:pieces0:e"},
+		{map[string]interface{}{"list": []interface{}{map[string]interface{}{"b": 1, "a": 2}}}, "d4:listld1:ai2e1:bi1eeee"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := bencode(&buf, test.v)
+		if err != nil {
+			t.Errorf("bencode(%v): %v", test.v, err)
+			continue
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("bencode(%v) = %q; want %q", test.v, got, test.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := bencode(&buf, 1.5); err == nil {
+		t.Errorf("bencode(1.5) succeeded; want error")
+	}
+}
+
+// writeTorrentTree writes the files of a small tree under dir, in the given order,
+// returning their entries.
+func writeTorrentTree(t *testing.T, dir string, files [][2]string) []torrentEntry {
+	entries := make([]torrentEntry, 0, len(files))
+	for _, file := range files {
+		absPath := filepath.Join(dir, filepath.FromSlash(file[0]))
+		err := os.MkdirAll(filepath.Dir(absPath), os.ModePerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(absPath, []byte(file[1]), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries = append(entries, torrentEntry{absPath: absPath, length: int64(len(file[1]))})
+	}
+
+	return entries
+}
+
+func TestHashPieces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sescrp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Pieces of 3 bytes over "abcde" and "fgh": "abc", "de" + "f" and "gh"
+	files := writeTorrentTree(t, dir, [][2]string{{"a", "abcde"}, {"b", "fgh"}})
+
+	pieces, err := hashPieces(files, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "a9993e364706816aba3e25717850c26c9cd0d89d" + // SHA-1 of "abc"
+		"589c22335a381f122d129225f5c0ba3056ed5811" + // SHA-1 of "def"
+		"1041179cbdda366fd7b0347f09255f775170e103" // SHA-1 of "gh"
+	if got := hex.EncodeToString(pieces); got != want {
+		t.Errorf("hashPieces = %s; want %s", got, want)
+	}
+}
+
+func TestMakeTorrent(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "sescrp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "library")
+	writeTorrentTree(t, dir, [][2]string{
+		{"a.epub", "abcde"},
+		{"sub/b.epub", "fgh"},
+		// Left out
+		{"c.epub.part", "partial"},
+		{".hidden/d.epub", "hidden"},
+	})
+
+	torrent, err := MakeTorrent(dir, TorrentOptions{ExcludeExts: []string{".part"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if torrent.Name != "library" || torrent.Files != 2 || torrent.Bytes != 8 {
+		t.Errorf("MakeTorrent = %q, %d files, %d bytes; want \"library\", 2 files, 8 bytes", torrent.Name, torrent.Files, torrent.Bytes)
+	}
+
+	// SHA-1 of d5:filesld6:lengthi5e4:pathl6:a.epubeed6:lengthi3e4:pathl3:sub6:b.epubeee
+	// 4:name7:library12:piece lengthi262144e6:pieces20:<SHA-1 of "abcdefgh">e
+	want := "96218492ee9ff21f1675604fc158e573e2b7f9da"
+	if got := hex.EncodeToString(torrent.InfoHash[:]); got != want {
+		t.Errorf("InfoHash = %s; want %s", got, want)
+	}
+}
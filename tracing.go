@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// TracingTransport is an http.RoundTripper that logs the timings of every phase
+// of each request: DNS lookup, connection, TLS handshake, time to first byte and
+// body transfer.
+type TracingTransport struct {
+	// Transport is the underlying http.RoundTripper. If nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+// requestTimings keeps the instants in which each phase of a request started and
+// ended.
+//
+// The httptrace hooks may be called from other goroutines, e. g. to dial IPv4 and
+// IPv6 addresses in parallel, so every field but start is guarded by mu.
+type requestTimings struct {
+	mu sync.Mutex
+
+	start                     time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	firstByte                 time.Time
+	reused                    bool
+}
+
+// mark sets one of the instants of t to now.
+func (t *requestTimings) mark(instant *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	*instant = time.Now()
+}
+
+// since returns the duration between two instants, or 0 if any of them didn't
+// happen (e. g. no DNS lookup for a reused connection).
+func since(from, to time.Time) time.Duration {
+	if from.IsZero() || to.IsZero() {
+		return 0
+	}
+
+	return to.Sub(from)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (tt *TracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := tt.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	timings := &requestTimings{}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			timings.mu.Lock()
+			timings.reused = info.Reused
+			timings.mu.Unlock()
+		},
+		DNSStart:             func(httptrace.DNSStartInfo) { timings.mark(&timings.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { timings.mark(&timings.dnsDone) },
+		ConnectStart:         func(string, string) { timings.mark(&timings.connectStart) },
+		ConnectDone:          func(string, string, error) { timings.mark(&timings.connectDone) },
+		TLSHandshakeStart:    func() { timings.mark(&timings.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { timings.mark(&timings.tlsDone) },
+		GotFirstResponseByte: func() { timings.mark(&timings.firstByte) },
+	}
+
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	timings.start = time.Now()
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		log.Printf("trace %s %s: failed after %v: %v", req.Method, req.URL, time.Since(timings.start), err)
+		return resp, err
+	}
+
+	resp.Body = &tracedBody{
+		ReadCloser: resp.Body,
+		req:        req,
+		timings:    timings,
+	}
+
+	return resp, nil
+}
+
+// tracedBody logs the timings of a request once its body is closed, so the
+// transfer time can be included.
+type tracedBody struct {
+	io.ReadCloser
+	req     *http.Request
+	timings *requestTimings
+	read    int64
+}
+
+func (tb *tracedBody) Read(p []byte) (int, error) {
+	n, err := tb.ReadCloser.Read(p)
+	tb.read += int64(n)
+
+	return n, err
+}
+
+func (tb *tracedBody) Close() error {
+	end := time.Now()
+	t := tb.timings
+
+	t.mu.Lock()
+	dns := since(t.dnsStart, t.dnsDone)
+	connect := since(t.connectStart, t.connectDone)
+	tlsHandshake := since(t.tlsStart, t.tlsDone)
+	ttfb := since(t.start, t.firstByte)
+	transfer := since(t.firstByte, end)
+	reused := t.reused
+	t.mu.Unlock()
+
+	log.Printf("trace %s %s: dns=%v connect=%v tls=%v ttfb=%v transfer=%v (%d bytes) total=%v reused=%t",
+		tb.req.Method, tb.req.URL, dns, connect, tlsHandshake, ttfb, transfer, tb.read, since(t.start, end), reused)
+
+	return tb.ReadCloser.Close()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// PageKind is the kind of a Standard Ebooks page, as far as sescrp is concerned.
+type PageKind int
+
+// Kinds of pages.
+const (
+	// UnknownPage is any page sescrp can't get books from.
+	UnknownPage PageKind = iota
+	// BookPageKind is the page of an individual ebook, e. g.
+	// "/ebooks/jane-austen/pride-and-prejudice".
+	BookPageKind
+	// AuthorPageKind is the page of an author, e. g. "/ebooks/jane-austen".
+	AuthorPageKind
+	// CollectionPageKind is the page of a collection, e. g.
+	// "/collections/the-modern-library".
+	CollectionPageKind
+)
+
+// String returns the name of the kind, e. g. for error messages.
+func (kind PageKind) String() string {
+	switch kind {
+	case BookPageKind:
+		return "book"
+	case AuthorPageKind:
+		return "author"
+	case CollectionPageKind:
+		return "collection"
+	default:
+		return "unknown"
+	}
+}
+
+// bookSubpages are the path segments that start the parts of a book below its
+// page, e. g. "/ebooks/jane-austen/emma/downloads/jane-austen_emma.epub".
+var bookSubpages = map[string]bool{
+	"downloads": true,
+	"text":      true,
+}
+
+// ClassifyURL returns the kind of page of a Standard Ebooks URL, by the segments
+// of its path.
+//
+// The scheme may be http or https, and the host may start with "www.". Empty
+// segments, e. g. from trailing or doubled slashes, as well as the query and
+// fragment, are ignored. Under "/ebooks/", one segment is an author and more are a
+// book, whatever their characters; a single segment under "/collections/" is a
+// collection.
+//
+// An error explains why the URL is not one of the pages sescrp can get books from.
+func ClassifyURL(rawURL string) (PageKind, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return UnknownPage, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return UnknownPage, fmt.Errorf("%s is not a web address; give the full URL, starting with %s", rawURL, StandardEbooksMainURL)
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if host != StandardEbooksMainURL.Hostname() {
+		return UnknownPage, fmt.Errorf("%s is not a Standard Ebooks URL", rawURL)
+	}
+
+	segments := pathSegments(u.Path)
+	if len(segments) == 0 {
+		return UnknownPage, fmt.Errorf("%s is the main page; give the URL of a book, author or collection", rawURL)
+	}
+
+	switch segments[0] {
+	case "ebooks":
+		if len(segments) == 1 {
+			return UnknownPage, fmt.Errorf("%s lists every ebook, which is not supported; give the URL of a book, author or collection", rawURL)
+		}
+
+		// A book's own slug may be anything, so only what comes after it is checked
+		for i := 3; i < len(segments); i++ {
+			if bookSubpages[segments[i]] {
+				bookURL := *StandardEbooksMainURL
+				bookURL.Path = "/" + strings.Join(segments[:i], "/")
+				return UnknownPage, fmt.Errorf("%s is part of a book, not its page; give %s instead", rawURL, bookURL.String())
+			}
+		}
+
+		if len(segments) == 2 {
+			return AuthorPageKind, nil
+		}
+		return BookPageKind, nil
+	case "collections":
+		if len(segments) == 1 {
+			return UnknownPage, fmt.Errorf("%s lists every collection, which is not supported; give the URL of a single collection", rawURL)
+		}
+		if len(segments) > 2 {
+			return UnknownPage, fmt.Errorf("%s is not the page of a collection", rawURL)
+		}
+
+		return CollectionPageKind, nil
+	default:
+		return UnknownPage, fmt.Errorf("%s is not the page of a book, author or collection", rawURL)
+	}
+}
+
+// CanonicalPageURL returns a URL accepted by ClassifyURL in its canonical form:
+// on StandardEbooksMainURL, without empty segments, query or fragment, e. g.
+// "http://www.standardebooks.org/ebooks/jane-austen/?x=1" becomes
+// "https://standardebooks.org/ebooks/jane-austen". Other URLs are returned as is.
+//
+// Variants of the same page are then fetched, deduplicated and paced as one.
+func CanonicalPageURL(rawURL string) string {
+	if _, err := ClassifyURL(rawURL); err != nil {
+		return rawURL
+	}
+
+	u, _ := url.Parse(rawURL)
+	canonical := *StandardEbooksMainURL
+	canonical.Path = "/" + strings.Join(pathSegments(u.Path), "/")
+
+	return canonical.String()
+}
+
+// pathSegments returns the non-empty segments of a URL path.
+func pathSegments(p string) []string {
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(p, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	return segments
+}
+
+// ExpandShorthand expands the short forms of Standard Ebooks URLs into full URLs:
+// bare slugs like "jane-austen/pride-and-prejudice" or "agatha-christie" are
+// taken as the paths of books or authors, paths like "/ebooks/jane-austen" or
+// "collections/the-modern-library" are taken from the main URL, and
+// "standardebooks.org/..." gets its scheme. Full URLs are returned as is, for
+// ClassifyURL to accept or explain.
+func ExpandShorthand(input string) string {
+	if strings.Contains(input, "://") || input == "" {
+		return input
+	}
+
+	lower := strings.ToLower(input)
+	if strings.HasPrefix(lower, StandardEbooksMainURL.Hostname()+"/") || strings.HasPrefix(lower, "www."+StandardEbooksMainURL.Hostname()+"/") {
+		return StandardEbooksMainURL.Scheme + "://" + input
+	}
+
+	path := strings.TrimPrefix(input, "/")
+	if !strings.HasPrefix(path, "ebooks/") && !strings.HasPrefix(path, "collections/") {
+		path = "ebooks/" + path
+	}
+
+	return StandardEbooksMainURL.String() + "/" + path
+}
+
+// PageKindOf is like ClassifyURL, but only returns the kind, e. g. for filtering
+// URLs already known to be valid.
+func PageKindOf(rawURL string) PageKind {
+	kind, _ := ClassifyURL(rawURL)
+	return kind
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestClassifyURL(t *testing.T) {
+	tests := []struct {
+		rawURL  string
+		kind    PageKind
+		wantErr bool
+	}{
+		// Books
+		{"https://standardebooks.org/ebooks/jane-austen/pride-and-prejudice", BookPageKind, false},
+		{"https://standardebooks.org/ebooks/jane-austen/pride-and-prejudice/", BookPageKind, false},
+		{"https://standardebooks.org/ebooks/jane-austen/pride-and-prejudice?source=feed", BookPageKind, false},
+		{"https://standardebooks.org/ebooks/jane-austen/pride-and-prejudice#description", BookPageKind, false},
+		{"https://www.standardebooks.org/ebooks/jane-austen/pride-and-prejudice", BookPageKind, false},
+		{"http://standardebooks.org/ebooks/jane-austen/pride-and-prejudice", BookPageKind, false},
+		{"https://standardebooks.org//ebooks//jane-austen//pride-and-prejudice", BookPageKind, false},
+		{"https://standardebooks.org/ebooks/h-g-wells/the-war-of-the-worlds/warwick-goble", BookPageKind, false},
+		{"https://standardebooks.org/ebooks/anonymous/the-1001-nights/john-payne", BookPageKind, false},
+
+		// Authors
+		{"https://standardebooks.org/ebooks/jane-austen", AuthorPageKind, false},
+		{"https://standardebooks.org/ebooks/jane-austen/", AuthorPageKind, false},
+		{"https://STANDARDEBOOKS.ORG/ebooks/jane-austen?sort=newest", AuthorPageKind, false},
+
+		// Collections
+		{"https://standardebooks.org/collections/the-modern-library", CollectionPageKind, false},
+		{"https://standardebooks.org/collections/the-modern-library/", CollectionPageKind, false},
+
+		// Rejected
+		{"https://standardebooks.org", UnknownPage, true},
+		{"https://standardebooks.org/", UnknownPage, true},
+		{"https://standardebooks.org/ebooks", UnknownPage, true},
+		{"https://standardebooks.org/ebooks/", UnknownPage, true},
+		{"https://standardebooks.org/collections", UnknownPage, true},
+		{"https://standardebooks.org/collections/the-modern-library/extra", UnknownPage, true},
+		{"https://standardebooks.org/about", UnknownPage, true},
+		{"https://standardebooks.org/ebooks/jane-austen/emma/downloads/jane-austen_emma.epub", UnknownPage, true},
+		{"https://standardebooks.org/ebooks/jane-austen/emma/text/chapter-1", UnknownPage, true},
+		{"https://standardebooks.org/ebooks/jane-austen/emma/text", UnknownPage, true},
+		{"https://example.com/ebooks/jane-austen/emma", UnknownPage, true},
+		{"https://notstandardebooks.org/ebooks/jane-austen/emma", UnknownPage, true},
+		{"ftp://standardebooks.org/ebooks/jane-austen/emma", UnknownPage, true},
+		{"standardebooks.org/ebooks/jane-austen/emma", UnknownPage, true},
+	}
+
+	for _, test := range tests {
+		kind, err := ClassifyURL(test.rawURL)
+		if kind != test.kind || (err != nil) != test.wantErr {
+			t.Errorf("ClassifyURL(%q) = %v, %v; want %v, error %v", test.rawURL, kind, err, test.kind, test.wantErr)
+		}
+	}
+}
+
+func TestCanonicalPageURL(t *testing.T) {
+	tests := []struct {
+		rawURL string
+		want   string
+	}{
+		{"https://standardebooks.org/ebooks/jane-austen/emma", "https://standardebooks.org/ebooks/jane-austen/emma"},
+		{"https://standardebooks.org/ebooks/jane-austen/emma/", "https://standardebooks.org/ebooks/jane-austen/emma"},
+		{"http://www.standardebooks.org/ebooks/jane-austen/?x=1#top", "https://standardebooks.org/ebooks/jane-austen"},
+		{"https://WWW.StandardEbooks.org//collections//the-modern-library/", "https://standardebooks.org/collections/the-modern-library"},
+
+		// Not accepted by ClassifyURL, so left for it to explain
+		{"https://example.com/ebooks/jane-austen/emma/", "https://example.com/ebooks/jane-austen/emma/"},
+		{"https://standardebooks.org/ebooks/jane-austen/emma/downloads/jane-austen_emma.epub", "https://standardebooks.org/ebooks/jane-austen/emma/downloads/jane-austen_emma.epub"},
+	}
+
+	for _, test := range tests {
+		if got := CanonicalPageURL(test.rawURL); got != test.want {
+			t.Errorf("CanonicalPageURL(%q) = %q; want %q", test.rawURL, got, test.want)
+		}
+	}
+}
+
+func TestExpandShorthand(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"jane-austen/pride-and-prejudice", "https://standardebooks.org/ebooks/jane-austen/pride-and-prejudice"},
+		{"agatha-christie", "https://standardebooks.org/ebooks/agatha-christie"},
+		{"/ebooks/jane-austen", "https://standardebooks.org/ebooks/jane-austen"},
+		{"collections/the-modern-library", "https://standardebooks.org/collections/the-modern-library"},
+		{"standardebooks.org/ebooks/jane-austen", "https://standardebooks.org/ebooks/jane-austen"},
+		{"www.standardebooks.org/ebooks/jane-austen", "https://www.standardebooks.org/ebooks/jane-austen"},
+		{"https://example.com/ebooks/jane-austen", "https://example.com/ebooks/jane-austen"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := ExpandShorthand(test.input); got != test.want {
+			t.Errorf("ExpandShorthand(%q) = %q; want %q", test.input, got, test.want)
+		}
+	}
+}
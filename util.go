@@ -1,9 +1,231 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 )
 
+// CopyBufferSize is the size of the buffers used by PooledCopy.
+const CopyBufferSize = 256 * 1024
+
+// copyBufferPool keeps copy buffers around between downloads, so the GC doesn't
+// have to deal with a new large buffer per file.
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, CopyBufferSize)
+		return &buf
+	},
+}
+
+// onlyWriter hides any io.ReaderFrom implementation of the underlying writer, so
+// io.CopyBuffer actually uses the given buffer.
+type onlyWriter struct {
+	io.Writer
+}
+
+// PooledCopy copies from src to dst like io.Copy, but using a buffer from a
+// shared pool instead of allocating a new one each time.
+//
+// When both ends are files, dst's io.ReaderFrom is used instead, as the OS can
+// then copy the data without it passing through userspace at all.
+func PooledCopy(dst io.Writer, src io.Reader) (int64, error) {
+	if readerFrom, ok := dst.(io.ReaderFrom); ok {
+		if _, srcIsFile := src.(*os.File); srcIsFile {
+			return readerFrom.ReadFrom(src)
+		}
+	}
+
+	bufPtr := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufPtr)
+
+	return io.CopyBuffer(onlyWriter{dst}, src, *bufPtr)
+}
+
+// MoveFile moves the file src to dst, replacing it if it exists.
+//
+// Within the same filesystem this is a rename, and dst appears all at once. Across
+// filesystems, src is copied to a temporary file next to dst, which is then
+// renamed into place, so dst is never seen half-written either.
+func MoveFile(src, dst string) error {
+	return moveFile(src, dst, os.Rename)
+}
+
+// MoveNewFile is like MoveFile, but fails with an error satisfying os.IsExist if
+// dst already exists, instead of replacing it.
+func MoveNewFile(src, dst string) error {
+	return moveFile(src, dst, placeNewFile)
+}
+
+// moveFile moves src to dst using place, which should behave like os.Rename.
+func moveFile(src, dst string, place func(from, to string) error) error {
+	err := place(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	linkErr, ok := err.(*os.LinkError)
+	if !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = PooledCopy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	// Keeping the modification time, as a rename would
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = place(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	in.Close()
+
+	return os.Remove(src)
+}
+
+// placeNewFile renames from to to, unless to already exists.
+func placeNewFile(from, to string) error {
+	// A hard link can't replace anything, so there's no race
+	err := os.Link(from, to)
+	if err == nil {
+		return os.Remove(from)
+	}
+	if linkErr, ok := err.(*os.LinkError); os.IsExist(err) || (ok && linkErr.Err == syscall.EXDEV) {
+		return err
+	}
+
+	// Filesystems without hard links, e. g. FAT in some reading devices
+	if _, err := os.Lstat(to); err == nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrExist}
+	}
+
+	return os.Rename(from, to)
+}
+
+// ReadPage reads the body of the response for a page, refusing it if it's over
+// maxSize bytes, e. g. an ebook file got as a page because of a misclassified URL.
+// A maxSize of 0 means no limit.
+func ReadPage(resp *http.Response, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	tooLarge := fmt.Errorf("response over the page size limit of %d bytes; it may not be a page at all, see -max-page-size", maxSize)
+	if resp.ContentLength > maxSize {
+		return nil, tooLarge
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, tooLarge
+	}
+
+	return body, nil
+}
+
+// SameContent reports whether two files have the same content.
+func SameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	infoA, err := fa.Stat()
+	if err != nil {
+		return false, err
+	}
+	infoB, err := fb.Stat()
+	if err != nil {
+		return false, err
+	}
+	if infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, 64*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// SyncPath flushes a file, or a directory and its entries, to disk.
+func SyncPath(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
 // MustParseURL attempts to parse an *url.URL from a string, with panic on error.
 func MustParseURL(rawURL string) *url.URL {
 	url, err := url.Parse(rawURL)
@@ -14,10 +236,76 @@ func MustParseURL(rawURL string) *url.URL {
 	return url
 }
 
+// Confirm asks a yes/no question in the terminal, returning true only if the user
+// answers yes. If the standard input is not a terminal, nobody can answer, so it
+// returns false right away.
+func Confirm(question string) bool {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
+
+// Choose lists the given options in the terminal and asks the user to pick one,
+// returning its index. It returns false if the user picks none, or if the
+// standard input is not a terminal.
+func Choose(question string, options []string) (int, bool) {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return 0, false
+	}
+
+	for i, option := range options {
+		fmt.Fprintf(os.Stderr, "%3d) %s\n", i+1, option)
+	}
+	fmt.Fprintf(os.Stderr, "%s [1-%d, or nothing to skip] ", question, len(options))
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return 0, false
+	}
+
+	choice, err := strconv.Atoi(strings.TrimSpace(answer))
+	if err != nil || choice < 1 || choice > len(options) {
+		return 0, false
+	}
+
+	return choice - 1, true
+}
+
+// BookURLOf returns the URL of the book page a file URL belongs to, e. g.
+// "/ebooks/jane-austen/emma" for "/ebooks/jane-austen/emma/downloads/jane-austen_emma.epub".
+// URLs that don't look like a book file are returned as they are.
+func BookURLOf(fileURL *url.URL) *url.URL {
+	i := strings.Index(fileURL.Path, "/downloads/")
+	if i < 0 {
+		return fileURL
+	}
+
+	bookURL := *fileURL
+	bookURL.Path = fileURL.Path[:i]
+	bookURL.RawPath = ""
+	bookURL.RawQuery = ""
+	bookURL.Fragment = ""
+
+	return &bookURL
+}
+
 // RemoveStringDuplicates remove duplicated string elements from a slice of strings
 func RemoveStringDuplicates(slice []string) []string {
-	returnSlice := make([]string, 0)
-	seen := make(map[string]struct{})
+	returnSlice := make([]string, 0, len(slice))
+	seen := make(map[string]struct{}, len(slice))
 
 	for _, s := range slice {
 		if _, wasThere := seen[s]; !wasThere {
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// copyBenchmarkSize is about the size of an epub.
+const copyBenchmarkSize = 1024 * 1024
+
+// plainReader hides the io.WriterTo of what it wraps, like an HTTP response body,
+// so the copy goes through a buffer.
+type plainReader struct{ io.Reader }
+
+// discardWriter is like ioutil.Discard, but without its io.ReaderFrom.
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func BenchmarkPooledCopy(b *testing.B) {
+	data := bytes.Repeat([]byte("sescrp"), copyBenchmarkSize/6)
+
+	copies := []struct {
+		name string
+		copy func(dst io.Writer, src io.Reader) (int64, error)
+	}{
+		{"PooledCopy", PooledCopy},
+		{"io.Copy", io.Copy},
+	}
+
+	for _, c := range copies {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+
+			for i := 0; i < b.N; i++ {
+				_, err := c.copy(discardWriter{}, plainReader{bytes.NewReader(data)})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, meant to be set at build time with something like:
+//
+//	go build -ldflags "-X main.Version=1.2.3 -X main.Commit=abc123 -X main.BuildDate=2020-07-08"
+//
+// If Version is not set, it's taken from the module version embedded by the Go
+// toolchain, if available, e. g. when installed with "go get".
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+
+	if Version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		Version = info.Main.Version
+	}
+}
+
+// VersionString returns a human readable description of the build.
+func VersionString() string {
+	commit := Commit
+	if commit == "" {
+		commit = "unknown"
+	}
+
+	buildDate := BuildDate
+	if buildDate == "" {
+		buildDate = "unknown"
+	}
+
+	return fmt.Sprintf("sescrp %s (commit %s, built %s, %s %s/%s)", Version, commit, buildDate, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// UserAgent returns the User-Agent header sent in every request.
+func UserAgent() string {
+	return fmt.Sprintf("sescrp/%s (+https://github.com/blackhawk42/sescrp)", Version)
+}
+
+// UserAgentTransport is an http.RoundTripper that sets the User-Agent header of
+// every request to UserAgent().
+type UserAgentTransport struct {
+	// Transport is the underlying http.RoundTripper. If nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (ut *UserAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := ut.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	// RoundTrippers must not modify the original request
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", UserAgent())
+
+	return transport.RoundTrip(req)
+}
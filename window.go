@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeWindow is a daily window of time, in local time, e. g. from 01:00 to 06:00.
+// It may cross midnight, e. g. from 22:00 to 06:00.
+type TimeWindow struct {
+	// Start and End are offsets from midnight.
+	Start, End time.Duration
+}
+
+// ParseTimeWindow parses a window in the form "HH:MM-HH:MM".
+func ParseTimeWindow(s string) (TimeWindow, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return TimeWindow{}, fmt.Errorf("expected a window like \"01:00-06:00\", got \"%s\"", s)
+	}
+
+	var window TimeWindow
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return TimeWindow{}, fmt.Errorf("invalid time \"%s\" in window \"%s\"", part, s)
+		}
+
+		offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			window.Start = offset
+		} else {
+			window.End = offset
+		}
+	}
+
+	if window.Start == window.End {
+		return TimeWindow{}, fmt.Errorf("the window \"%s\" is empty", s)
+	}
+
+	return window, nil
+}
+
+// Until returns how long it is from t until the window opens, or 0 if t is
+// already inside it.
+func (tw TimeWindow) Until(t time.Time) time.Duration {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+
+	var inside bool
+	if tw.Start < tw.End {
+		inside = offset >= tw.Start && offset < tw.End
+	} else {
+		inside = offset >= tw.Start || offset < tw.End
+	}
+	if inside {
+		return 0
+	}
+
+	start := midnight.Add(tw.Start)
+	if !start.After(t) {
+		start = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(tw.Start)
+	}
+
+	return start.Sub(t)
+}
+
+// Wait blocks until the window is open, if it's not already.
+func (tw TimeWindow) Wait() {
+	for {
+		wait := tw.Until(time.Now())
+		if wait <= 0 {
+			return
+		}
+
+		time.Sleep(wait)
+	}
+}